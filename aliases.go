@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Local Aliases ---
+//
+// [Aliases] File names an aliases file in the style of /etc/aliases:
+//
+//	# alias: member, member, ...
+//	alerts@contoso.com: ops@contoso.com, oncall
+//	oncall: alice@contoso.com, :include:oncall.txt
+//
+// An alias without a domain matches that local part in any domain. Members
+// may be other aliases; :include: reads further members, one or more per
+// line, from a file relative to the aliases file. The files are reloaded
+// when their modification time changes.
+
+var errEmptyAlias = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Alias has no deliverable members",
+}
+
+type aliasTable struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string][]string  // Lower-cased alias -> members
+	files   map[string]time.Time // Files read, with their modification times
+}
+
+var aliases = &aliasTable{}
+
+// loadAliases reads the aliases file. An empty path disables aliases.
+func loadAliases(path string) error {
+	aliases.mu.Lock()
+	defer aliases.mu.Unlock()
+	aliases.path = path
+	aliases.entries, aliases.files = nil, nil
+	if path == "" {
+		return nil
+	}
+	return aliases.load()
+}
+
+// load reads the aliases file and its includes. After a failure the files
+// of this attempt are remembered, so it is only repeated once one of them
+// changes. Callers hold t.mu.
+func (t *aliasTable) load() (err error) {
+	entries := make(map[string][]string)
+	files := make(map[string]time.Time)
+	defer func() {
+		if err != nil {
+			t.files = files
+		}
+	}()
+
+	lines, err := readAliasFile(t.path, files)
+	if err != nil {
+		return err
+	}
+	for i, line := range lines {
+		name, list, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("%s:%d: expected alias: member, ...", t.path, i+1)
+		}
+		var members []string
+		for _, m := range strings.Split(list, ",") {
+			m = strings.TrimSpace(m)
+			if path, ok := strings.CutPrefix(m, ":include:"); ok {
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(filepath.Dir(t.path), path)
+				}
+				included, err := readAliasFile(path, files)
+				if err != nil {
+					return err
+				}
+				for _, l := range included {
+					for _, im := range strings.Split(l, ",") {
+						if im = strings.TrimSpace(im); im != "" {
+							members = append(members, im)
+						}
+					}
+				}
+				continue
+			}
+			if m != "" {
+				members = append(members, m)
+			}
+		}
+		key := strings.ToLower(strings.TrimSpace(name))
+		entries[key] = append(entries[key], members...)
+	}
+
+	t.entries, t.files = entries, files
+	logger.Printf("Loaded %d alias(es) from %s", len(entries), t.path)
+	return nil
+}
+
+// readAliasFile returns the non-empty, non-comment lines of a file, joining
+// lines that start with whitespace to the previous one, and records the
+// file's modification time, the zero time for a file that cannot be read.
+func readAliasFile(path string, files map[string]time.Time) ([]string, error) {
+	files[path] = time.Time{}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open aliases file: %w", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		files[path] = info.ModTime()
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		text := strings.TrimSpace(raw)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if len(lines) > 0 && (raw[0] == ' ' || raw[0] == '\t') {
+			lines[len(lines)-1] += " " + text
+			continue
+		}
+		lines = append(lines, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// reloadIfChanged re-reads the files when any of them changed. On error the
+// previous aliases stay in effect. Callers hold t.mu.
+func (t *aliasTable) reloadIfChanged() {
+	changed := false
+	for path, mtime := range t.files {
+		if !fileModTime(path).Equal(mtime) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := t.load(); err != nil {
+		logger.Printf("Failed to reload aliases, keeping previous version: %v", err)
+	}
+}
+
+// fileModTime returns the modification time of a file, or the zero time
+// if it cannot be read.
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// lookup returns the members of an alias. Callers hold t.mu.
+func (t *aliasTable) lookup(address string) ([]string, bool) {
+	lower := strings.ToLower(address)
+	if members, ok := t.entries[lower]; ok {
+		return members, true
+	}
+	if at := strings.LastIndex(lower, "@"); at > 0 {
+		members, ok := t.entries[lower[:at]]
+		return members, ok
+	}
+	return nil, false
+}
+
+// expandAlias returns the addresses an address delivers to: itself when it
+// is not an alias, otherwise the fully expanded members without duplicates.
+// A member that leads back to an alias being expanded ends the expansion.
+func expandAlias(address string) []string {
+	aliases.mu.Lock()
+	defer aliases.mu.Unlock()
+	if aliases.entries == nil {
+		return []string{address}
+	}
+	aliases.reloadIfChanged()
+
+	var out []string
+	var expand func(addr string, path []string)
+	expand = func(addr string, path []string) {
+		members, ok := aliases.lookup(addr)
+		if !ok {
+			if !containsFold(out, addr) {
+				out = append(out, addr)
+			}
+			return
+		}
+		if containsFold(path, addr) {
+			// An alias listing its own address delivers to that mailbox,
+			// as in /etc/aliases; a bare name cannot be delivered.
+			if !strings.Contains(addr, "@") {
+				logger.Printf("Alias loop detected: %s -> %s", strings.Join(path, " -> "), addr)
+				return
+			}
+			if !containsFold(out, addr) {
+				out = append(out, addr)
+			}
+			return
+		}
+		path = append(path, addr)
+		for _, m := range members {
+			expand(m, path)
+		}
+	}
+	expand(address, nil)
+
+	if len(out) != 1 || !strings.EqualFold(out[0], address) {
+		debugLog("Expanded alias %s -> %s", address, strings.Join(out, ", "))
+	}
+	return out
+}
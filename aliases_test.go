@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestAliases writes the aliases file and any extra files to a
+// temporary directory and loads it.
+func writeTestAliases(t *testing.T, content string, extra map[string]string) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range extra {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "aliases")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadAliases("") })
+	return path, loadAliases(path)
+}
+
+func TestLoadAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		extra   map[string]string
+		want    map[string][]string
+		wantErr string
+	}{
+		{
+			"simple",
+			"# comment\n\nAlerts@Contoso.com: ops@contoso.com, oncall\n",
+			nil,
+			map[string][]string{"alerts@contoso.com": {"ops@contoso.com", "oncall"}},
+			"",
+		},
+		{
+			"continuation line",
+			"team: a@contoso.com,\n  b@contoso.com,\n\tc@contoso.com\n",
+			nil,
+			map[string][]string{"team": {"a@contoso.com", "b@contoso.com", "c@contoso.com"}},
+			"",
+		},
+		{
+			"repeated alias",
+			"team: a@contoso.com\nteam: b@contoso.com\n",
+			nil,
+			map[string][]string{"team": {"a@contoso.com", "b@contoso.com"}},
+			"",
+		},
+		{
+			"include",
+			"oncall: alice@contoso.com, :include:oncall.txt\n",
+			map[string]string{"oncall.txt": "# rota\nbob@contoso.com, carol@contoso.com\n\ndave@contoso.com\n"},
+			map[string][]string{"oncall": {"alice@contoso.com", "bob@contoso.com", "carol@contoso.com", "dave@contoso.com"}},
+			"",
+		},
+		{
+			"empty members",
+			"team: a@contoso.com, , \n",
+			nil,
+			map[string][]string{"team": {"a@contoso.com"}},
+			"",
+		},
+		{"missing colon", "team a@contoso.com\n", nil, nil, ":1: expected alias: member"},
+		{"missing name", "ok: a@contoso.com\n: b@contoso.com\n", nil, nil, ":2: expected alias: member"},
+		{"missing include", "team: :include:nowhere.txt\n", nil, nil, "failed to open aliases file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeTestAliases(t, tt.content, tt.extra)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAliases error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(aliases.entries, tt.want) {
+				t.Errorf("entries = %q, want %q", aliases.entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAlias(t *testing.T) {
+	const content = `alerts@contoso.com: ops@contoso.com, oncall
+oncall: alice@contoso.com, Bob@contoso.com
+ops@contoso.com: ops@contoso.com, bob@contoso.com
+loop1: loop2
+loop2: loop1, carol@contoso.com
+support: help
+empty:
+`
+	if _, err := writeTestAliases(t, content, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		want    []string
+	}{
+		{"nobody@contoso.com", []string{"nobody@contoso.com"}},
+		{"ALERTS@contoso.com", []string{"ops@contoso.com", "bob@contoso.com", "alice@contoso.com"}},
+		{"oncall@fabrikam.com", []string{"alice@contoso.com", "Bob@contoso.com"}},
+		{"ops@contoso.com", []string{"ops@contoso.com", "bob@contoso.com"}},
+		{"loop1@contoso.com", []string{"carol@contoso.com"}},
+		{"support@contoso.com", []string{"help"}},
+		{"empty@contoso.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if got := expandAlias(tt.address); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandAlias(%q) = %q, want %q", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAliasDisabled(t *testing.T) {
+	if err := loadAliases(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := expandAlias("team"); !reflect.DeepEqual(got, []string{"team"}) {
+		t.Errorf("expandAlias = %q, want the address itself", got)
+	}
+}
+
+func TestAliasReload(t *testing.T) {
+	path, err := writeTestAliases(t, "team: a@contoso.com\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Modification times may be coarse; make sure this one differs
+		later := aliases.files[path].Add(time.Second)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	touch("team: b@contoso.com\n")
+	if got := expandAlias("team"); !reflect.DeepEqual(got, []string{"b@contoso.com"}) {
+		t.Errorf("after change: expandAlias = %q", got)
+	}
+
+	// A broken file keeps the previous aliases
+	touch("team b@contoso.com\n")
+	if got := expandAlias("team"); !reflect.DeepEqual(got, []string{"b@contoso.com"}) {
+		t.Errorf("after broken change: expandAlias = %q", got)
+	}
+}
+
+func TestAliasReloadMissingInclude(t *testing.T) {
+	path, err := writeTestAliases(t, "team: :include:team.txt\n", map[string]string{"team.txt": "a@contoso.com\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	include := filepath.Join(filepath.Dir(path), "team.txt")
+	var logged strings.Builder
+	saved := logger
+	t.Cleanup(func() { logger = saved })
+	logger = log.New(&logged, "", 0)
+
+	if err := os.Remove(include); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got := expandAlias("team"); !reflect.DeepEqual(got, []string{"a@contoso.com"}) {
+			t.Errorf("with the include deleted: expandAlias = %q", got)
+		}
+	}
+	if n := strings.Count(logged.String(), "Failed to reload aliases"); n != 1 {
+		t.Errorf("reload failure logged %d times, want once:\n%s", n, logged.String())
+	}
+
+	// Restoring the include loads it again
+	if err := os.WriteFile(include, []byte("b@contoso.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := expandAlias("team"); !reflect.DeepEqual(got, []string{"b@contoso.com"}) {
+		t.Errorf("after restoring the include: expandAlias = %q", got)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// --- Attachment Policy ---
+//
+// [AttachmentPolicy] decides what happens to attachments before a message
+// is delivered:
+//
+//	[AttachmentPolicy]
+//	BlockedExtensions = exe, js, vbs, scr, docm, xlsm
+//	BlockedAction = reject
+//	AllowedTypes = application/pdf, image/*, text/*
+//	TypeAction = strip
+//	MaxAttachmentBytes = 10485760
+//	MaxTotalBytes = 26214400
+//	SizeAction = reject
+//
+// Every rule has its own action: reject the message, strip the attachment
+// and add a notice to the body, or quarantine the message. Extensions are
+// checked against the file name and against the type found by sniffing the
+// content, so renaming an executable to .pdf does not get it through, and
+// against the entries of ZIP archives.
+
+// Attachment policy actions.
+const (
+	actionReject     = "reject"
+	actionStrip      = "strip"
+	actionQuarantine = "quarantine"
+)
+
+// AttachmentPolicy is the parsed [AttachmentPolicy] section.
+type AttachmentPolicy struct {
+	BlockedExtensions  []string
+	BlockedAction      string
+	AllowedTypes       []string // MIME types; type/* matches a whole top-level type
+	TypeAction         string
+	MaxAttachmentBytes int64
+	MaxTotalBytes      int64
+	SizeAction         string
+}
+
+func loadAttachmentPolicy(sec *ini.Section) AttachmentPolicy {
+	actions := []string{actionReject, actionStrip, actionQuarantine}
+	p := AttachmentPolicy{
+		BlockedAction:      strings.ToLower(sec.Key("BlockedAction").In(actionReject, actions)),
+		TypeAction:         strings.ToLower(sec.Key("TypeAction").In(actionStrip, actions)),
+		MaxAttachmentBytes: sec.Key("MaxAttachmentBytes").MustInt64(0),
+		MaxTotalBytes:      sec.Key("MaxTotalBytes").MustInt64(0),
+		SizeAction:         strings.ToLower(sec.Key("SizeAction").In(actionReject, actions)),
+	}
+	for _, ext := range sec.Key("BlockedExtensions").Strings(",") {
+		p.BlockedExtensions = append(p.BlockedExtensions, strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	for _, t := range sec.Key("AllowedTypes").Strings(",") {
+		p.AllowedTypes = append(p.AllowedTypes, strings.ToLower(t))
+	}
+	return p
+}
+
+// attachmentDecision is the policy outcome for one attachment.
+type attachmentDecision struct {
+	attachment Attachment
+	action     string // "" keeps the attachment
+	reason     string
+}
+
+// attachmentVerdict is the policy outcome for a message.
+type attachmentVerdict struct {
+	decisions  []attachmentDecision
+	kept       []Attachment
+	notices    []string // One per stripped attachment
+	reject     string   // Reason, if the message must be rejected
+	quarantine string   // Reason, if the message must be quarantined
+	oversize   bool     // The rejection is for size
+}
+
+// rejectError returns the SMTP error for a rejected message.
+func (v *attachmentVerdict) rejectError() error {
+	if v.oversize {
+		return &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "Message rejected: " + v.reject}
+	}
+	return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message rejected: " + v.reject}
+}
+
+// keepQuarantined keeps the attachments that would have quarantined the
+// message, for a message an administrator released.
+func (v *attachmentVerdict) keepQuarantined() {
+	v.kept = v.kept[:0]
+	for _, d := range v.decisions {
+		if d.action == "" || d.action == actionQuarantine {
+			v.kept = append(v.kept, d.attachment)
+		}
+	}
+	v.quarantine = ""
+}
+
+// evaluateAttachments applies the attachment policy to a message's
+// attachments. The message is rejected if any attachment is, otherwise
+// quarantined if any attachment is.
+func evaluateAttachments(attachments []Attachment) *attachmentVerdict {
+	p := &config.AttachmentPolicy
+	v := &attachmentVerdict{}
+	var total int64
+	for _, a := range attachments {
+		d := attachmentDecision{attachment: a}
+		oversize := false
+		sniffed := sniffAttachment(a)
+		blocked := p.blocked(a, sniffed)
+		switch {
+		case p.MaxAttachmentBytes > 0 && a.Size > p.MaxAttachmentBytes:
+			d.action, d.reason = p.SizeAction, fmt.Sprintf("%d bytes exceeds the limit of %d", a.Size, p.MaxAttachmentBytes)
+			oversize = true
+		case blocked != "":
+			d.action, d.reason = p.BlockedAction, blocked
+		case !p.typeAllowed(a.ContentType, sniffed.contentType):
+			d.action, d.reason = p.TypeAction, "type "+effectiveType(a.ContentType, sniffed.contentType)+" is not allowed"
+		case p.MaxTotalBytes > 0 && total+a.Size > p.MaxTotalBytes:
+			// Attachments that are removed anyway do not count towards the
+			// total, so the first ones to fit are the ones kept.
+			d.action, d.reason = p.SizeAction, fmt.Sprintf("attachments total more than %d bytes", p.MaxTotalBytes)
+			oversize = true
+		default:
+			total += a.Size
+		}
+
+		switch d.action {
+		case actionReject:
+			if v.reject == "" {
+				v.reject = fmt.Sprintf("attachment %q: %s", a.Name, d.reason)
+				v.oversize = oversize
+			}
+		case actionQuarantine:
+			if v.quarantine == "" {
+				v.quarantine = fmt.Sprintf("attachment %q: %s", a.Name, d.reason)
+			}
+		case actionStrip:
+			v.notices = append(v.notices, fmt.Sprintf("The attachment %q was removed by the mail relay: %s.", a.Name, d.reason))
+		default:
+			v.kept = append(v.kept, a)
+		}
+		v.decisions = append(v.decisions, d)
+	}
+	return v
+}
+
+// logAttachmentDecisions logs the decision for every attachment.
+func logAttachmentDecisions(v *attachmentVerdict) {
+	for _, d := range v.decisions {
+		a := d.attachment
+		if d.action == "" {
+			logger.Printf("Attachment policy: %q (%s, %d bytes) allowed", a.Name, a.ContentType, a.Size)
+			continue
+		}
+		logger.Printf("Attachment policy: %q (%s, %d bytes) %s: %s", a.Name, a.ContentType, a.Size, d.action, d.reason)
+	}
+}
+
+// enabled reports whether the policy has any rules.
+func (p *AttachmentPolicy) enabled() bool {
+	return len(p.BlockedExtensions) > 0 || len(p.AllowedTypes) > 0 || p.MaxAttachmentBytes > 0 || p.MaxTotalBytes > 0
+}
+
+// blocked returns why an attachment matches a blocked extension, or "".
+func (p *AttachmentPolicy) blocked(a Attachment, sniffed sniffResult) string {
+	if len(p.BlockedExtensions) == 0 {
+		return ""
+	}
+	if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(a.Name)), "."); ext != "" && containsFold(p.BlockedExtensions, ext) {
+		return "extension ." + ext + " is blocked"
+	}
+	for _, kind := range sniffed.kinds {
+		if containsFold(p.BlockedExtensions, kind) {
+			return "content is " + kind + " (" + sniffed.describe() + ")"
+		}
+	}
+	for _, name := range sniffed.archived {
+		if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), "."); ext != "" && containsFold(p.BlockedExtensions, ext) {
+			return "archive contains " + name
+		}
+	}
+	return ""
+}
+
+// typeAllowed checks the allowlist against the sniffed type, or the
+// declared type when sniffing found nothing specific.
+func (p *AttachmentPolicy) typeAllowed(declared, sniffed string) bool {
+	if len(p.AllowedTypes) == 0 {
+		return true
+	}
+	t := effectiveType(declared, sniffed)
+	for _, allowed := range p.AllowedTypes {
+		if allowed == t || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(t, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func effectiveType(declared, sniffed string) string {
+	if sniffed != "" && sniffed != "application/octet-stream" && sniffed != "text/plain" {
+		return sniffed
+	}
+	return strings.ToLower(declared)
+}
+
+// sniffResult is what the content of an attachment turned out to be.
+type sniffResult struct {
+	contentType string   // From http.DetectContentType, without parameters
+	kinds       []string // Extension-like labels for executable or macro content
+	archived    []string // Names of the entries of a ZIP archive
+}
+
+func (r sniffResult) describe() string {
+	if r.contentType == "" {
+		return "unknown type"
+	}
+	return r.contentType
+}
+
+// Signatures of content that is dangerous whatever its file name.
+var contentSignatures = []struct {
+	magic []byte
+	kinds []string
+}{
+	{[]byte("MZ"), []string{"exe", "dll", "scr", "com"}},
+	{[]byte("\x7fELF"), []string{"elf"}},
+	{[]byte("\xca\xfe\xba\xbe"), []string{"class"}},
+	{[]byte("#!"), []string{"sh"}},
+	{[]byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), []string{"ole"}}, // Legacy Office and MSI
+}
+
+// sniffAttachment inspects the content of an attachment.
+func sniffAttachment(a Attachment) sniffResult {
+	var res sniffResult
+	r, err := a.Open()
+	if err != nil {
+		return res
+	}
+	defer r.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(r, head)
+	head = head[:n]
+
+	res.contentType, _, _ = strings.Cut(http.DetectContentType(head), ";")
+	for _, sig := range contentSignatures {
+		if bytes.HasPrefix(head, sig.magic) {
+			res.kinds = append(res.kinds, sig.kinds...)
+		}
+	}
+
+	if bytes.HasPrefix(head, []byte("PK\x03\x04")) {
+		if zr, err := zip.OpenReader(a.path); err == nil {
+			macros := false
+			for _, f := range zr.File {
+				res.archived = append(res.archived, f.Name)
+				if strings.EqualFold(filepath.Base(f.Name), "vbaProject.bin") {
+					macros = true
+				}
+			}
+			zr.Close()
+			if macros {
+				// An Office Open XML document with a VBA project is a
+				// macro-enabled document, whatever its name says.
+				res.kinds = append(res.kinds, "docm", "xlsm", "pptm")
+				res.archived = nil
+			}
+		}
+	}
+	return res
+}
+
+// checkAttachmentsAtData applies the attachment policy while the client is
+// still connected, so a message the policy rejects gets an SMTP error
+// instead of being accepted and dropped. Other decisions are left to
+// processEmail, which logs them.
+func checkAttachmentsAtData(trans *EmailTransaction) error {
+	if !config.AttachmentPolicy.enabled() {
+		return nil
+	}
+	data, err := trans.openData()
+	if err != nil {
+		return nil
+	}
+	defer data.Close()
+	msg, err := mail.CreateReader(bufio.NewReader(data))
+	if err != nil {
+		return nil // processEmail reports the parse error
+	}
+	workDir, err := createTempDir("parts-*")
+	if err != nil {
+		return nil
+	}
+	defer os.RemoveAll(workDir)
+	parts, err := extractParts(msg, workDir)
+	if err != nil {
+		return nil
+	}
+
+	verdict := evaluateAttachments(parts.attachments)
+	if verdict.reject == "" {
+		return nil
+	}
+	logAttachmentDecisions(verdict)
+	return verdict.rejectError()
+}
+
+// addNotices appends the notices for stripped attachments to the bodies.
+func addNotices(textBody, htmlBody string, notices []string) (string, string) {
+	if len(notices) == 0 {
+		return textBody, htmlBody
+	}
+	if htmlBody != "" {
+		var b strings.Builder
+		for _, n := range notices {
+			b.WriteString("<p><em>" + html.EscapeString(n) + "</em></p>")
+		}
+		htmlBody = insertBeforeBodyEnd(htmlBody, b.String())
+	}
+	if textBody != "" || htmlBody == "" {
+		textBody = strings.TrimRight(textBody, "\r\n") + "\r\n\r\n" + strings.Join(notices, "\r\n") + "\r\n"
+	}
+	return textBody, htmlBody
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"github.com/emersion/go-smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAttachment writes content to a file and returns it as an attachment.
+func testAttachment(t *testing.T, name, contentType string, content []byte) Attachment {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "part")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Attachment{Name: name, ContentType: contentType, Size: int64(len(content)), path: path}
+}
+
+// zipOf returns a ZIP archive with empty entries of the given names.
+func zipOf(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAttachmentPolicyBlocked(t *testing.T) {
+	p := &AttachmentPolicy{BlockedExtensions: []string{"exe", "js", "elf", "sh", "docm"}}
+	pdf := []byte("%PDF-1.7\n1 0 obj\n")
+
+	tests := []struct {
+		name       string
+		attachment Attachment
+		want       string // Substring of the reason; "" when allowed
+	}{
+		{"clean pdf", testAttachment(t, "report.pdf", "application/pdf", pdf), ""},
+		{"blocked extension", testAttachment(t, "setup.EXE", "application/octet-stream", []byte("data")), "extension .exe is blocked"},
+		{"script by name", testAttachment(t, "invoice.pdf.js", "text/plain", []byte("alert(1)")), "extension .js is blocked"},
+		{"renamed executable", testAttachment(t, "invoice.pdf", "application/pdf", []byte("MZ\x90\x00\x03")), "content is exe"},
+		{"ELF binary", testAttachment(t, "notes.txt", "text/plain", []byte("\x7fELF\x02\x01\x01")), "content is elf"},
+		{"shell script", testAttachment(t, "run", "text/plain", []byte("#!/bin/sh\nrm -rf /\n")), "content is sh"},
+		{"executable in zip", testAttachment(t, "docs.zip", "application/zip", zipOf(t, "readme.txt", "bin/Tool.exe")), "archive contains bin/Tool.exe"},
+		{"clean zip", testAttachment(t, "docs.zip", "application/zip", zipOf(t, "readme.txt", "report.pdf")), ""},
+		{"macro document", testAttachment(t, "budget.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			zipOf(t, "[Content_Types].xml", "word/document.xml", "word/vbaProject.bin")), "content is docm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.blocked(tt.attachment, sniffAttachment(tt.attachment))
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("blocked = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentPolicyTypes(t *testing.T) {
+	p := &AttachmentPolicy{AllowedTypes: []string{"application/pdf", "image/*"}}
+	for declared, sniffed := range map[string]string{
+		"application/pdf":          "application/pdf",
+		"image/png":                "image/png",
+		"IMAGE/JPEG":               "application/octet-stream", // Nothing specific found
+		"application/octet-stream": "image/gif",                // Content wins over the label
+	} {
+		if !p.typeAllowed(declared, sniffed) {
+			t.Errorf("typeAllowed(%q, %q) = false", declared, sniffed)
+		}
+	}
+	for declared, sniffed := range map[string]string{
+		"application/pdf": "text/html; charset=utf-8",
+		"text/plain":      "text/plain",
+		"imagex/png":      "",
+	} {
+		if p.typeAllowed(declared, sniffed) {
+			t.Errorf("typeAllowed(%q, %q) = true", declared, sniffed)
+		}
+	}
+}
+
+func TestEvaluateAttachments(t *testing.T) {
+	saved := config.AttachmentPolicy
+	t.Cleanup(func() { config.AttachmentPolicy = saved })
+	config.AttachmentPolicy = AttachmentPolicy{
+		BlockedExtensions: []string{"exe"},
+		BlockedAction:     actionQuarantine,
+		AllowedTypes:      []string{"application/pdf", "text/*"},
+		TypeAction:        actionStrip,
+		MaxTotalBytes:     10,
+		SizeAction:        actionStrip,
+	}
+	a := testAttachment(t, "a.txt", "text/plain", []byte("123456"))
+	b := testAttachment(t, "b.html", "text/html", []byte("<p>x</p>"))
+	c := testAttachment(t, "c.txt", "text/plain", []byte("123456"))
+	d := testAttachment(t, "d.txt", "text/plain", []byte("1234"))
+	zipped := testAttachment(t, "e.zip", "application/zip", zipOf(t, "x.pdf"))
+
+	v := evaluateAttachments([]Attachment{a, b, c, d, zipped})
+	var kept []string
+	for _, k := range v.kept {
+		kept = append(kept, k.Name)
+	}
+	// b.html is text/*; c.txt does not fit in the total, d.txt does; the
+	// zip is not an allowed type
+	if strings.Join(kept, ",") != "a.txt,d.txt" {
+		t.Errorf("kept %v, want a.txt and d.txt", kept)
+	}
+	if len(v.notices) != 3 || v.reject != "" || v.quarantine != "" {
+		t.Errorf("verdict = %+v, want three stripped attachments", v)
+	}
+
+	exe := testAttachment(t, "tool.exe", "application/octet-stream", []byte("MZ"))
+	if v := evaluateAttachments([]Attachment{a, exe}); !strings.Contains(v.quarantine, `"tool.exe"`) || v.reject != "" {
+		t.Errorf("blocked attachment: verdict = %+v, want quarantine", v)
+	}
+
+	config.AttachmentPolicy.MaxAttachmentBytes, config.AttachmentPolicy.SizeAction = 5, actionReject
+	v = evaluateAttachments([]Attachment{exe, a})
+	var smtpErr *smtp.SMTPError
+	if !v.oversize || !errors.As(v.rejectError(), &smtpErr) || smtpErr.Code != 552 {
+		t.Errorf("oversize attachment: verdict = %+v, want a 552 rejection", v)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Audit Log ---
+//
+// With [Audit] File set, every message the relay handles is recorded as one
+// JSON object per line: its envelope and recipients, subject, size,
+// attachments with their SHA-256, and the outcome with the request-id and
+// latency. Messages refused at the end of DATA are recorded too.
+//
+// Each entry holds the hash of the previous one in "prev" and its own in
+// "hash", the SHA-256 of the entry as written without its hash field. A
+// changed or deleted entry breaks the chain, which verify-audit checks.
+// Deleting entries from the end cannot be detected from the file alone;
+// keep the last hash verify-audit prints somewhere else to detect that.
+
+// auditAttachment is an attachment as recorded in the audit log.
+type auditAttachment struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// auditEntry is one line of the audit log. Hash must stay the last field;
+// see auditHash.
+type auditEntry struct {
+	Time        time.Time         `json:"time"`
+	SessionID   string            `json:"sessionId,omitempty"`
+	ClientIP    string            `json:"clientIp,omitempty"`
+	AuthUser    string            `json:"authUser,omitempty"`
+	From        string            `json:"from"`
+	Recipients  []string          `json:"recipients"` // Envelope recipients
+	To          []string          `json:"to,omitempty"`
+	Cc          []string          `json:"cc,omitempty"`
+	Bcc         []string          `json:"bcc,omitempty"`
+	Subject     string            `json:"subject,omitempty"`
+	Size        int64             `json:"size"`
+	Attachments []auditAttachment `json:"attachments,omitempty"`
+	Transport   string            `json:"transport,omitempty"`
+	RequestID   string            `json:"requestId,omitempty"`
+	Outcome     string            `json:"outcome"` // delivered, quarantined, discarded, rejected, deferred or failed
+	Error       string            `json:"error,omitempty"`
+	Undelivered []string          `json:"undelivered,omitempty"` // Recipients of copies that failed, when others were delivered
+	LatencyMS   int64             `json:"latencyMs"`
+	Prev        string            `json:"prev"`
+	Hash        string            `json:"hash,omitempty"`
+}
+
+// auditMu serialises writers in this process; a lock on the file does the
+// same for other processes, such as sendmail, so each entry is chained to
+// the one before.
+var auditMu sync.Mutex
+
+// newAuditEntry starts the entry for the message of trans.
+func newAuditEntry(trans *EmailTransaction, sender string) *auditEntry {
+	e := &auditEntry{
+		SessionID:  trans.sessionID,
+		AuthUser:   trans.authUser,
+		From:       sender,
+		Recipients: trans.to,
+		Size:       trans.dataSize,
+	}
+	if trans.clientIP != nil {
+		e.ClientIP = trans.clientIP.String()
+	}
+	return e
+}
+
+// setAttachments records the names and hashes of attachments.
+func (e *auditEntry) setAttachments(attachments []Attachment) {
+	if config.AuditFile == "" {
+		return
+	}
+	for _, a := range attachments {
+		sum, err := hashAttachment(a)
+		if err != nil {
+			logger.Printf("Audit: failed to hash attachment %q: %v", a.Name, err)
+		}
+		e.Attachments = append(e.Attachments, auditAttachment{Name: a.Name, Size: a.Size, SHA256: sum})
+	}
+}
+
+func hashAttachment(a Attachment) (string, error) {
+	r, err := a.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// finish records the outcome of processEmail and writes the entry.
+func (e *auditEntry) finish(result *DeliveryResult, err error, latency time.Duration) {
+	e.LatencyMS = latency.Milliseconds()
+	switch {
+	case err != nil && isTemporary(err):
+		e.Outcome, e.Error = "deferred", err.Error()
+	case err != nil:
+		e.Outcome, e.Error = "failed", err.Error()
+	case result.Transport == "quarantine":
+		e.Outcome = "quarantined"
+	case result.Transport == "discard":
+		e.Outcome = "discarded"
+	default:
+		e.Outcome = "delivered"
+	}
+	if result != nil {
+		e.Transport, e.RequestID = result.Transport, result.RequestID
+	}
+	if failed, delivered := partialDelivery(err); len(delivered) > 0 {
+		e.Undelivered = failed
+	}
+	writeAudit(e)
+}
+
+// auditRejected records a message refused at the end of DATA.
+func auditRejected(trans *EmailTransaction, header mail.Header, err error) {
+	if config.AuditFile == "" {
+		return
+	}
+	e := newAuditEntry(trans, trans.from)
+	e.Subject, _ = header.Subject()
+	e.Outcome, e.Error = "rejected", err.Error()
+	writeAudit(e)
+}
+
+// writeAudit chains e to the last entry of the audit log and appends it.
+func writeAudit(e *auditEntry) {
+	if config.AuditFile == "" {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(config.AuditFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		logger.Printf("Audit: failed to open %s: %v", config.AuditFile, err)
+		return
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		logger.Printf("Audit: failed to lock %s: %v", config.AuditFile, err)
+		return
+	}
+	defer unlockFile(f)
+
+	// The last hash is read from the file under the lock every time, so
+	// entries written by other processes and rotation keep the chain intact
+	prev, err := lastAuditHash(f)
+	if err != nil {
+		logger.Printf("Audit: %v; starting a new chain", err)
+	}
+	e.Time = time.Now().UTC()
+	e.Prev = prev
+	line, err := auditLine(e)
+	if err != nil {
+		logger.Printf("Audit: %v", err)
+		return
+	}
+	if _, err := f.Write(line); err != nil {
+		logger.Printf("Audit: failed to write %s: %v", config.AuditFile, err)
+	}
+}
+
+// auditLine sets the hash of e and returns it as a line of the log.
+func auditLine(e *auditEntry) ([]byte, error) {
+	e.Hash = ""
+	unhashed, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	e.Hash = auditHash(unhashed)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// auditHash hashes an entry written without its hash field.
+func auditHash(unhashed []byte) string {
+	sum := sha256.Sum256(unhashed)
+	return hex.EncodeToString(sum[:])
+}
+
+// unhashedEntry recovers the bytes an entry's hash was computed over. As
+// the hash is the last field, the line ends in ,"hash":"<hash>"}.
+func unhashedEntry(line []byte, hash string) ([]byte, bool) {
+	suffix := []byte(`,"hash":"` + hash + `"}`)
+	if !bytes.HasSuffix(line, suffix) {
+		return nil, false
+	}
+	return append(line[:len(line)-len(suffix):len(line)-len(suffix)], '}'), true
+}
+
+// lastAuditHash returns the hash of the last entry in f, or "" if it is
+// empty.
+func lastAuditHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size == 0 {
+		return "", nil
+	}
+
+	// Read backwards until the start of the last line is found
+	for chunk := int64(4096); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+		buf := make([]byte, chunk)
+		if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return "", err
+		}
+		buf = bytes.TrimRight(buf, "\r\n")
+		i := bytes.LastIndexByte(buf, '\n')
+		if i < 0 && chunk < size {
+			continue
+		}
+		var last struct {
+			Hash string `json:"hash"`
+		}
+		if err := json.Unmarshal(buf[i+1:], &last); err != nil || last.Hash == "" {
+			return "", fmt.Errorf("last entry of %s is unreadable", f.Name())
+		}
+		return last.Hash, nil
+	}
+}
+
+// verifyAudit implements the verify-audit command: it checks the hash of
+// every entry and that each names the one before it.
+func verifyAudit(args []string) error {
+	path := config.AuditFile
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		return fmt.Errorf("usage: verify-audit [file]; no [Audit] File is configured")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	prev := ""
+	n := 0
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		n++
+		line = bytes.TrimRight(line, "\r\n")
+
+		var e struct {
+			Prev string `json:"prev"`
+			Hash string `json:"hash"`
+		}
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("line %d: not a valid entry: %v", n, err)
+		}
+		unhashed, ok := unhashedEntry(line, e.Hash)
+		if !ok || auditHash(unhashed) != e.Hash {
+			return fmt.Errorf("line %d: the entry does not match its hash; it was changed", n)
+		}
+		if e.Prev != prev {
+			return fmt.Errorf("line %d: the previous entry is missing or was changed", n)
+		}
+		prev = e.Hash
+	}
+
+	fmt.Printf("%s: %d entries, chain intact\n", path, n)
+	if n > 0 {
+		fmt.Printf("Last hash: %s\n", prev)
+	}
+	return nil
+}
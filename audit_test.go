@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAudit writes n entries to a new audit log and returns its lines.
+func writeTestAudit(t *testing.T, n int) (string, [][]byte) {
+	t.Helper()
+	saved := config.AuditFile
+	t.Cleanup(func() { config.AuditFile = saved })
+	config.AuditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+
+	for i := 0; i < n; i++ {
+		writeAudit(&auditEntry{
+			From:       "app@contoso.com",
+			Recipients: []string{"ops@contoso.com"},
+			Subject:    "Report " + strings.Repeat("x", i),
+			Size:       int64(100 + i),
+			Outcome:    "delivered",
+		})
+	}
+	data, err := os.ReadFile(config.AuditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	return config.AuditFile, lines[:len(lines)-1]
+}
+
+func TestVerifyAudit(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines [][]byte) [][]byte
+		wantErr string
+	}{
+		{"intact", func(lines [][]byte) [][]byte { return lines }, ""},
+		{"empty", func(lines [][]byte) [][]byte { return nil }, ""},
+		{"last entry removed", func(lines [][]byte) [][]byte { return lines[:2] }, ""},
+		{"CRLF line endings", func(lines [][]byte) [][]byte {
+			for i, l := range lines {
+				lines[i] = append(bytes.TrimSuffix(l, []byte("\n")), "\r\n"...)
+			}
+			return lines
+		}, ""},
+		{"field changed", func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"size":101`), []byte(`"size":999`), 1)
+			return lines
+		}, "line 2: the entry does not match its hash"},
+		{"hash changed", func(lines [][]byte) [][]byte {
+			lines[0] = bytes.Replace(lines[0], []byte(`"hash":"`), []byte(`"hash":"0`), 1)
+			return lines
+		}, "line 1: the entry does not match its hash"},
+		{"entry removed", func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, "line 2: the previous entry is missing or was changed"},
+		{"first entry removed", func(lines [][]byte) [][]byte { return lines[1:] }, "line 1: the previous entry is missing"},
+		{"entries swapped", func(lines [][]byte) [][]byte {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, "line 2: the previous entry is missing or was changed"},
+		{"not JSON", func(lines [][]byte) [][]byte {
+			return append(lines, []byte("garbage\n"))
+		}, "line 4: not a valid entry"},
+		{"hash field moved", func(lines [][]byte) [][]byte {
+			lines[2] = bytes.Replace(lines[2], []byte(`{"time"`), []byte(`{"extra":1,"time"`), 1)
+			return lines
+		}, "line 3: the entry does not match its hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, lines := writeTestAudit(t, 3)
+			if len(lines) != 3 {
+				t.Fatalf("audit log has %d lines, want 3", len(lines))
+			}
+			if err := os.WriteFile(path, bytes.Join(tt.tamper(lines), nil), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := verifyAudit([]string{path})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyAudit: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyAudit error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
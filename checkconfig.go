@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// --- check-config Command ---
+
+// checkReport collects pass/fail lines for the check-config command.
+type checkReport struct {
+	failed int
+}
+
+func (r *checkReport) pass(format string, v ...interface{}) {
+	fmt.Printf("[PASS] "+format+"\n", v...)
+}
+
+func (r *checkReport) fail(format string, v ...interface{}) {
+	r.failed++
+	fmt.Printf("[FAIL] "+format+"\n", v...)
+}
+
+// checkConfig validates the loaded configuration, confirms the app registration
+// can send mail and optionally looks up the given sender mailboxes. It returns
+// false when any check failed.
+func checkConfig(senders []string) bool {
+	report := &checkReport{}
+
+	fmt.Printf("Checking configuration from %s\n", configPath)
+
+	// With tenants configured, each tenant's app registration is checked
+	// instead of [MicrosoftGraph].
+	type registration struct {
+		section string
+		creds   GraphCredentials
+	}
+	registrations := []registration{{"MicrosoftGraph", config.graphCredentials()}}
+	if len(config.Tenants) > 0 {
+		registrations = nil
+		for _, t := range config.Tenants {
+			registrations = append(registrations, registration{"Tenant." + t.Name, t.Credentials})
+			if len(t.Domains) == 0 {
+				report.fail("Tenant.%s has no Domains", t.Name)
+			}
+		}
+	}
+
+	for _, reg := range registrations {
+		required := []struct {
+			name  string
+			value string
+		}{
+			{reg.section + ".TenantID", reg.creds.TenantID},
+			{reg.section + ".ClientID", reg.creds.ClientID},
+			{reg.section + ".ClientSecret", reg.creds.ClientSecret},
+			{reg.section + ".Scope", reg.creds.Scope},
+		}
+		for _, r := range required {
+			switch {
+			case r.value == "":
+				report.fail("%s is not set", r.name)
+			case strings.HasPrefix(r.value, "<") && strings.HasSuffix(r.value, ">"):
+				report.fail("%s still contains the placeholder %s", r.name, r.value)
+			default:
+				report.pass("%s is set", r.name)
+			}
+		}
+	}
+
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		report.fail("Server.SMTPPort %q is not a valid port number", config.Port)
+	} else {
+		report.pass("Server.SMTPPort %d is valid", port)
+	}
+
+	if config.Host == "" {
+		report.fail("Server.Host is not set")
+	} else if net.ParseIP(config.Host) != nil {
+		report.pass("Server.Host %s is a valid IP address", config.Host)
+	} else if _, err := net.LookupHost(config.Host); err != nil {
+		report.fail("Server.Host %s does not resolve: %v", config.Host, err)
+	} else {
+		report.pass("Server.Host %s resolves", config.Host)
+	}
+
+	if report.failed > 0 {
+		fmt.Println("Skipping Microsoft Graph checks until the settings above are fixed.")
+		return summarizeChecks(report)
+	}
+
+	tokens := make(map[string]string)
+	for _, reg := range registrations {
+		token, err := getAccessToken(reg.creds)
+		if err != nil {
+			report.fail("%s: access token could not be acquired: %v", reg.section, err)
+			continue
+		}
+		report.pass("%s: access token acquired for tenant %s", reg.section, reg.creds.TenantID)
+		tokens[reg.section] = token
+
+		roles, err := tokenRoles(token)
+		switch {
+		case err != nil:
+			report.fail("%s: access token could not be decoded: %v", reg.section, err)
+		case containsFold(roles, "Mail.Send"):
+			report.pass("%s: Mail.Send application permission is granted (roles: %s)", reg.section, strings.Join(roles, ", "))
+		default:
+			report.fail("%s: Mail.Send application permission is missing (roles: %s)", reg.section, strings.Join(roles, ", "))
+		}
+	}
+
+	for _, sender := range senders {
+		section := "MicrosoftGraph"
+		if len(config.Tenants) > 0 {
+			tenant := tenantForSender(sender)
+			if tenant == nil {
+				report.fail("Sender %s is not in the domains of any tenant", sender)
+				continue
+			}
+			section = "Tenant." + tenant.Name
+		}
+		token, ok := tokens[section]
+		if !ok {
+			report.fail("Sender %s could not be verified: no access token for %s", sender, section)
+			continue
+		}
+
+		user, err := lookupUser(token, sender)
+		if err != nil {
+			report.fail("Sender %s could not be verified: %v", sender, err)
+			continue
+		}
+		if user.Mail == "" {
+			report.fail("Sender %s exists (%s) but has no mailbox", sender, user.UserPrincipalName)
+			continue
+		}
+		report.pass("Sender %s resolves to mailbox %s (%s)", sender, user.Mail, user.DisplayName)
+	}
+
+	return summarizeChecks(report)
+}
+
+func summarizeChecks(report *checkReport) bool {
+	if report.failed > 0 {
+		fmt.Printf("check-config: %d check(s) failed\n", report.failed)
+		return false
+	}
+	fmt.Println("check-config: all checks passed")
+	return true
+}
+
+// tokenRoles extracts the application roles from a JWT access token without
+// verifying its signature; the token came straight from the token endpoint.
+func tokenRoles(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload: %w", err)
+	}
+	var claims struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+	return claims.Roles, nil
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Recipient Chunking ---
+//
+// Graph rejects messages with too many recipients. When a message has more
+// than [Delivery] RecipientsPerMessage recipients it is delivered as several
+// copies. To and Cc are never split: they are delivered with the first
+// copy, and only the Bcc recipients are spread over the copies. Every copy
+// keeps the original To and Cc lists; transports that render MIME show
+// them on every copy and deliver by the envelope. Graph has no envelope:
+// sendMail, in JSON or MIME, delivers to every address in the message. A
+// copy that listed To and Cc would reach them again, so with Graph they
+// appear only on the copy that delivers to them. With [Delivery] Explode
+// every recipient gets a copy of their own.
+//
+// Which copies were delivered is tracked, so that a retry only sends the
+// copies that failed and reports name only their recipients.
+
+// sendChunked hands msg to transport, split into copies as configured. The
+// result describes the first copy, with the attempts and time of all
+// copies. An error means at least one copy failed; its DeliveryError lists
+// the recipients that were and were not reached.
+func sendChunked(transport Transport, env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	visible := uniqueAddresses(append(append([]string{}, msg.To...), msg.Cc...))
+	hidden := notIn(uniqueAddresses(msg.Bcc), visible)
+	visible, hidden = notIn(visible, msg.Delivered), notIn(hidden, msg.Delivered)
+	pending := append(append([]string{}, visible...), hidden...)
+
+	size := config.RecipientsPerMessage
+	if config.Explode {
+		size = 1
+	}
+	if len(msg.Delivered) == 0 && (size <= 0 || len(pending) <= size) {
+		return transport.Send(env, msg)
+	}
+	if len(pending) == 0 {
+		logger.Printf("Message from %s was delivered to every recipient by an earlier attempt", env.From)
+		return &DeliveryResult{Transport: transport.Name()}, nil
+	}
+
+	var chunks [][]string
+	switch {
+	case config.Explode:
+		for _, rcpt := range pending {
+			chunks = append(chunks, []string{rcpt})
+		}
+	case size <= 0:
+		chunks = append(chunks, pending)
+	default:
+		if len(visible) > 0 {
+			if len(visible) > size {
+				logger.Printf("Message from %s has %d To and Cc recipients, more than %d; they are sent on one copy", env.From, len(visible), size)
+			}
+			n := size - len(visible)
+			if n < 0 {
+				n = 0
+			}
+			if n > len(hidden) {
+				n = len(hidden)
+			}
+			chunks = append(chunks, append(visible, hidden[:n]...))
+			hidden = hidden[n:]
+		}
+		for start := 0; start < len(hidden); start += size {
+			end := start + size
+			if end > len(hidden) {
+				end = len(hidden)
+			}
+			chunks = append(chunks, hidden[start:end])
+		}
+	}
+	logger.Printf("Splitting message from %s to %d recipient(s) into %d copies of up to %d", env.From, len(pending), len(chunks), size)
+
+	var (
+		total     *DeliveryResult
+		errs      []string
+		failed    []string
+		delivered []string
+		temporary bool
+		start     = time.Now()
+	)
+	for i, chunk := range chunks {
+		part := *msg
+		part.Recipients = chunk
+		part.Bcc = onlyIn(msg.Bcc, chunk)
+		partEnv := &Envelope{From: env.From, To: chunk}
+
+		result, err := transport.Send(partEnv, &part)
+		if err != nil {
+			logger.Printf("Copy %d/%d to %d recipient(s) failed: %v", i+1, len(chunks), len(chunk), err)
+			errs = append(errs, fmt.Sprintf("copy %d: %v", i+1, err))
+			failed = append(failed, chunk...)
+			temporary = temporary || isTemporary(err)
+			continue
+		}
+		delivered = append(delivered, chunk...)
+		if result.Transport == "" {
+			result.Transport = transport.Name()
+		}
+		logger.Printf("Copy %d/%d to %d recipient(s) delivered via %s (id %s)", i+1, len(chunks), len(chunk), result.Transport, result.RequestID)
+
+		if total == nil {
+			total = &DeliveryResult{Transport: result.Transport, RequestID: result.RequestID}
+		}
+		total.Attempts += result.Attempts
+	}
+
+	if len(errs) > 0 {
+		return nil, &DeliveryError{
+			Err:       fmt.Errorf("%d of %d copies failed: %s", len(errs), len(chunks), strings.Join(errs, "; ")),
+			Temporary: temporary,
+			Failed:    failed,
+			Delivered: delivered,
+		}
+	}
+	total.Duration = time.Since(start)
+	return total, nil
+}
+
+// partialDelivery returns the recipients a message split into copies was
+// not delivered to and those it was, or nil if err does not say; then the
+// failure applies to every recipient.
+func partialDelivery(err error) (failed, delivered []string) {
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return de.Failed, de.Delivered
+	}
+	return nil, nil
+}
+
+// uniqueAddresses returns list without duplicates, keeping the order.
+func uniqueAddresses(list []string) []string {
+	var out []string
+	for _, addr := range list {
+		if !containsFold(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// recordingTransport records the copies it is given and fails those that
+// include an address of failFor.
+type recordingTransport struct {
+	copies  []OutboundMessage
+	failFor map[string]error
+}
+
+func (r *recordingTransport) Name() string { return "recording" }
+
+func (r *recordingTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	r.copies = append(r.copies, *msg)
+	for _, rcpt := range env.To {
+		if err := r.failFor[rcpt]; err != nil {
+			return nil, err
+		}
+	}
+	return &DeliveryResult{RequestID: "id", Attempts: 1}, nil
+}
+
+// useRecordingTransport returns a recording transport and sets the chunk
+// size.
+func useRecordingTransport(t *testing.T, size int, explode bool) *recordingTransport {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	rec := &recordingTransport{failFor: make(map[string]error)}
+	config.RecipientsPerMessage, config.Explode = size, explode
+	return rec
+}
+
+func chunkTestMessage() *OutboundMessage {
+	return &OutboundMessage{
+		To:  []string{"a@contoso.com", "b@contoso.com"},
+		Cc:  []string{"c@contoso.com", "A@contoso.com"},
+		Bcc: []string{"d@contoso.com", "e@contoso.com"},
+	}
+}
+
+func copyRecipients(copies []OutboundMessage) [][]string {
+	var out [][]string
+	for _, c := range copies {
+		out = append(out, allRecipients(&c))
+	}
+	return out
+}
+
+func sendTestChunks(rec *recordingTransport, msg *OutboundMessage) (*DeliveryResult, error) {
+	return sendChunked(rec, &Envelope{From: "app@contoso.com", To: uniqueAddresses(allRecipients(msg))}, msg)
+}
+
+func TestSendChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		explode bool
+		want    [][]string
+	}{
+		{"unlimited", 0, false, [][]string{{"a@contoso.com", "b@contoso.com", "c@contoso.com", "A@contoso.com", "d@contoso.com", "e@contoso.com"}}},
+		{"fits", 5, false, [][]string{{"a@contoso.com", "b@contoso.com", "c@contoso.com", "A@contoso.com", "d@contoso.com", "e@contoso.com"}}},
+		{"To and Cc stay together", 2, false, [][]string{
+			{"a@contoso.com", "b@contoso.com", "c@contoso.com"}, {"d@contoso.com", "e@contoso.com"},
+		}},
+		{"Bcc fills the first copy", 4, false, [][]string{
+			{"a@contoso.com", "b@contoso.com", "c@contoso.com", "d@contoso.com"}, {"e@contoso.com"},
+		}},
+		{"explode", 0, true, [][]string{
+			{"a@contoso.com"}, {"b@contoso.com"}, {"c@contoso.com"}, {"d@contoso.com"}, {"e@contoso.com"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := useRecordingTransport(t, tt.size, tt.explode)
+			msg := chunkTestMessage()
+			result, err := sendTestChunks(rec, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := copyRecipients(rec.copies); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("copies = %q, want %q", got, tt.want)
+			}
+			for _, c := range rec.copies {
+				if !reflect.DeepEqual(c.To, msg.To) || !reflect.DeepEqual(c.Cc, msg.Cc) {
+					t.Errorf("copy lost To/Cc: %q %q", c.To, c.Cc)
+				}
+				if c.Recipients != nil && !reflect.DeepEqual(c.Bcc, onlyIn(msg.Bcc, c.Recipients)) {
+					t.Errorf("copy to %q shows Bcc %q", c.Recipients, c.Bcc)
+				}
+			}
+			if len(rec.copies) > 1 && result.Attempts != len(rec.copies) {
+				t.Errorf("attempts = %d, want %d", result.Attempts, len(rec.copies))
+			}
+		})
+	}
+}
+
+func TestSendChunkedPartialFailure(t *testing.T) {
+	rec := useRecordingTransport(t, 4, false)
+	rec.failFor["e@contoso.com"] = &DeliveryError{Err: errors.New("throttled"), Temporary: true}
+
+	msg := chunkTestMessage()
+	_, err := sendTestChunks(rec, msg)
+	if err == nil || !isTemporary(err) {
+		t.Fatalf("err = %v, want a temporary error", err)
+	}
+	failed, delivered := partialDelivery(err)
+	if !reflect.DeepEqual(failed, []string{"e@contoso.com"}) ||
+		!reflect.DeepEqual(delivered, []string{"a@contoso.com", "b@contoso.com", "c@contoso.com", "d@contoso.com"}) {
+		t.Fatalf("failed %q, delivered %q", failed, delivered)
+	}
+
+	// The retry only sends the copy that failed, still showing To and Cc
+	delete(rec.failFor, "e@contoso.com")
+	rec.copies = nil
+	msg.Delivered = delivered
+	if _, err := sendTestChunks(rec, msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := copyRecipients(rec.copies); !reflect.DeepEqual(got, [][]string{{"e@contoso.com"}}) {
+		t.Errorf("retry sent %q, want only e@contoso.com", got)
+	}
+	if !reflect.DeepEqual(rec.copies[0].To, msg.To) {
+		t.Errorf("retried copy lost To: %q", rec.copies[0].To)
+	}
+
+	// Nothing is left once every recipient has been reached
+	rec.copies = nil
+	msg.Delivered = append(msg.Delivered, "E@contoso.com")
+	if _, err := sendTestChunks(rec, msg); err != nil || len(rec.copies) != 0 {
+		t.Errorf("fully delivered message: err %v, %d copies sent", err, len(rec.copies))
+	}
+}
+
+func TestPartialDeliveryOtherErrors(t *testing.T) {
+	for _, err := range []error{nil, errors.New("parse error"), &DeliveryError{Err: errors.New("down"), Temporary: true}} {
+		if failed, delivered := partialDelivery(err); failed != nil || delivered != nil {
+			t.Errorf("partialDelivery(%v) = %q, %q; want nothing", err, failed, delivered)
+		}
+	}
+}
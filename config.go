@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// --- Configuration Overrides ---
+//
+// Every setting can come from three places. Later sources win:
+//
+//  1. config.ini (optional; missing file means built-in defaults)
+//  2. environment variables (RELAY_*)
+//  3. command-line flags (-graph-client-secret=...)
+
+// configOption describes a config.ini key that can also be set from the
+// environment or the command line.
+type configOption struct {
+	section string
+	key     string
+	env     string
+	flag    string
+	usage   string
+	isBool  bool
+}
+
+var configOptions = []configOption{
+	{section: "MicrosoftGraph", key: "TenantID", env: "RELAY_GRAPH_TENANT_ID", flag: "graph-tenant-id", usage: "Entra tenant ID or domain"},
+	{section: "MicrosoftGraph", key: "ClientID", env: "RELAY_GRAPH_CLIENT_ID", flag: "graph-client-id", usage: "application (client) ID"},
+	{section: "MicrosoftGraph", key: "ClientSecret", env: "RELAY_GRAPH_CLIENT_SECRET", flag: "graph-client-secret", usage: "application client secret"},
+	{section: "MicrosoftGraph", key: "Scope", env: "RELAY_GRAPH_SCOPE", flag: "graph-scope", usage: "OAuth scope for the token request"},
+	{section: "Server", key: "Host", env: "RELAY_SERVER_HOST", flag: "host", usage: "address the SMTP server listens on"},
+	{section: "Server", key: "SMTPPort", env: "RELAY_SERVER_SMTP_PORT", flag: "port", usage: "port the SMTP server listens on"},
+	{section: "Server", key: "MaxMessageBytes", env: "RELAY_SERVER_MAX_MESSAGE_BYTES", flag: "max-message-bytes", usage: "largest accepted message in bytes (advertised as SIZE)"},
+	{section: "Server", key: "MaxRecipients", env: "RELAY_SERVER_MAX_RECIPIENTS", flag: "max-recipients", usage: "recipients per SMTP transaction (0 is unlimited)"},
+	{section: "Server", key: "ReadTimeout", env: "RELAY_SERVER_READ_TIMEOUT", flag: "read-timeout", usage: "idle time allowed while reading from a client"},
+	{section: "Server", key: "WriteTimeout", env: "RELAY_SERVER_WRITE_TIMEOUT", flag: "write-timeout", usage: "time allowed for writing a reply to a client"},
+	{section: "Server", key: "MaxConnections", env: "RELAY_SERVER_MAX_CONNECTIONS", flag: "max-connections", usage: "concurrent SMTP connections (0 is unlimited)"},
+	{section: "Server", key: "MaxConnectionsPerIP", env: "RELAY_SERVER_MAX_CONNECTIONS_PER_IP", flag: "max-connections-per-ip", usage: "concurrent SMTP connections per client IP (0 is unlimited)"},
+	{section: "Server", key: "TempDirectory", env: "RELAY_SERVER_TEMP_DIRECTORY", flag: "temp-directory", usage: "directory for message data being processed"},
+	{section: "Server", key: "MemoryBudget", env: "RELAY_SERVER_MEMORY_BUDGET", flag: "memory-budget", usage: "bytes of message bodies held in memory at once (0 is unlimited)"},
+	{section: "Service", key: "ServiceName", env: "RELAY_SERVICE_NAME", flag: "service-name", usage: "Windows service name"},
+	{section: "Service", key: "Debug", env: "RELAY_DEBUG", flag: "debug", usage: "enable debug logging", isBool: true},
+	{section: "Service", key: "DryRun", env: "RELAY_DRY_RUN", flag: "dry-run", usage: "write Graph requests to disk instead of sending them", isBool: true},
+	{section: "Service", key: "DryRunDirectory", env: "RELAY_DRY_RUN_DIRECTORY", flag: "dry-run-directory", usage: "output directory for dry-run requests"},
+	{section: "RecipientPolicy", key: "AllowedDomains", env: "RELAY_POLICY_ALLOWED_DOMAINS", flag: "allowed-domains", usage: "recipient domains mail may be sent to"},
+	{section: "RecipientPolicy", key: "AllowedAddresses", env: "RELAY_POLICY_ALLOWED_ADDRESSES", flag: "allowed-addresses", usage: "recipient addresses that are always allowed"},
+	{section: "RecipientPolicy", key: "DeniedDomains", env: "RELAY_POLICY_DENIED_DOMAINS", flag: "denied-domains", usage: "recipient domains that are rejected"},
+	{section: "RecipientPolicy", key: "DeniedAddresses", env: "RELAY_POLICY_DENIED_ADDRESSES", flag: "denied-addresses", usage: "recipient addresses that are rejected"},
+	{section: "RecipientPolicy", key: "InternalDomains", env: "RELAY_POLICY_INTERNAL_DOMAINS", flag: "internal-domains", usage: "domains counted as internal"},
+	{section: "RecipientPolicy", key: "InternalOnlySenders", env: "RELAY_POLICY_INTERNAL_ONLY_SENDERS", flag: "internal-only-senders", usage: "senders limited to internal recipients"},
+	{section: "RecipientPolicy", key: "InternalOnlyNetworks", env: "RELAY_POLICY_INTERNAL_ONLY_NETWORKS", flag: "internal-only-networks", usage: "client networks limited to internal recipients"},
+	{section: "AttachmentPolicy", key: "BlockedExtensions", env: "RELAY_ATTACHMENT_BLOCKED_EXTENSIONS", flag: "blocked-extensions", usage: "attachment extensions blocked by name or content"},
+	{section: "AttachmentPolicy", key: "BlockedAction", env: "RELAY_ATTACHMENT_BLOCKED_ACTION", flag: "blocked-action", usage: "action for blocked attachments: reject, strip or quarantine"},
+	{section: "AttachmentPolicy", key: "AllowedTypes", env: "RELAY_ATTACHMENT_ALLOWED_TYPES", flag: "allowed-types", usage: "attachment MIME types allowed (empty allows all)"},
+	{section: "AttachmentPolicy", key: "TypeAction", env: "RELAY_ATTACHMENT_TYPE_ACTION", flag: "type-action", usage: "action for attachments of other types"},
+	{section: "AttachmentPolicy", key: "MaxAttachmentBytes", env: "RELAY_ATTACHMENT_MAX_BYTES", flag: "max-attachment-bytes", usage: "largest single attachment (0 disables)"},
+	{section: "AttachmentPolicy", key: "MaxTotalBytes", env: "RELAY_ATTACHMENT_MAX_TOTAL_BYTES", flag: "max-attachment-total-bytes", usage: "largest total of attachments (0 disables)"},
+	{section: "AttachmentPolicy", key: "SizeAction", env: "RELAY_ATTACHMENT_SIZE_ACTION", flag: "size-action", usage: "action for attachments over a size limit"},
+	{section: "Quarantine", key: "Directory", env: "RELAY_QUARANTINE_DIRECTORY", flag: "quarantine-directory", usage: "directory for quarantined messages"},
+	{section: "Quarantine", key: "Retention", env: "RELAY_QUARANTINE_RETENTION", flag: "quarantine-retention", usage: "how long quarantined messages are kept; 0 keeps them until deleted"},
+	{section: "Scanner", key: "Address", env: "RELAY_SCANNER_ADDRESS", flag: "scanner-address", usage: "clamd address: host:port or unix:/path (empty disables scanning)"},
+	{section: "Scanner", key: "Mode", env: "RELAY_SCANNER_MODE", flag: "scanner-mode", usage: "scan the whole message or each attachment: message or attachments"},
+	{section: "Scanner", key: "Action", env: "RELAY_SCANNER_ACTION", flag: "scanner-action", usage: "action for infected messages: reject or quarantine"},
+	{section: "Scanner", key: "FailOpen", env: "RELAY_SCANNER_FAIL_OPEN", flag: "scanner-fail-open", usage: "deliver unscanned when clamd is unavailable", isBool: true},
+	{section: "Scanner", key: "Timeout", env: "RELAY_SCANNER_TIMEOUT", flag: "scanner-timeout", usage: "clamd connection and scan timeout"},
+	{section: "Rules", key: "File", env: "RELAY_RULES_FILE", flag: "rules", usage: "ordered rules file for routing and transforming messages"},
+	{section: "Milter", key: "Servers", env: "RELAY_MILTER_SERVERS", flag: "milters", usage: "milters to consult: inet:host:port or unix:/path"},
+	{section: "Milter", key: "DefaultAction", env: "RELAY_MILTER_DEFAULT_ACTION", flag: "milter-default-action", usage: "when a milter fails: accept, tempfail or reject"},
+	{section: "Milter", key: "Timeout", env: "RELAY_MILTER_TIMEOUT", flag: "milter-timeout", usage: "milter connection and reply timeout"},
+	{section: "Aliases", key: "File", env: "RELAY_ALIASES_FILE", flag: "aliases", usage: "aliases file expanded for every recipient"},
+	{section: "Rewrite", key: "MapFile", env: "RELAY_REWRITE_MAP_FILE", flag: "rewrite-map", usage: "file with sender and recipient rewrite rules"},
+	{section: "Rewrite", key: "DefaultSender", env: "RELAY_REWRITE_DEFAULT_SENDER", flag: "default-sender", usage: "sender used when a message has none or an unserved one"},
+	{section: "SenderValidation", key: "Enabled", env: "RELAY_SENDER_VALIDATION", flag: "validate-senders", usage: "verify sender mailboxes in Graph at MAIL FROM", isBool: true},
+	{section: "SenderValidation", key: "PositiveTTL", env: "RELAY_SENDER_POSITIVE_TTL", flag: "sender-positive-ttl", usage: "how long a verified sender is cached"},
+	{section: "SenderValidation", key: "NegativeTTL", env: "RELAY_SENDER_NEGATIVE_TTL", flag: "sender-negative-ttl", usage: "how long an unknown sender is cached"},
+	{section: "NDR", key: "Postmaster", env: "RELAY_NDR_POSTMASTER", flag: "ndr-postmaster", usage: "mailbox non-delivery reports are sent from; empty sends none"},
+	{section: "Audit", key: "File", env: "RELAY_AUDIT_FILE", flag: "audit-file", usage: "JSON Lines audit log of every message; empty disables it"},
+	{section: "Spool", key: "Directory", env: "RELAY_SPOOL_DIRECTORY", flag: "spool-directory", usage: "directory for messages awaiting delivery"},
+	{section: "Spool", key: "PollInterval", env: "RELAY_SPOOL_POLL_INTERVAL", flag: "spool-poll-interval", usage: "how often the spool is scanned"},
+	{section: "Spool", key: "MaxAttempts", env: "RELAY_SPOOL_MAX_ATTEMPTS", flag: "spool-max-attempts", usage: "delivery attempts before a spooled message is marked failed"},
+	{section: "Sendmail", key: "Delivery", env: "RELAY_SENDMAIL_DELIVERY", flag: "sendmail-delivery", usage: "sendmail mode delivery: direct or spool"},
+	{section: "Delivery", key: "Transport", env: "RELAY_DELIVERY_TRANSPORT", flag: "transport", usage: "delivery transport: graph, smtp, file or webhook"},
+	{section: "Delivery", key: "Targets", env: "RELAY_DELIVERY_TARGETS", flag: "targets", usage: "ordered failover targets ([Target.<name>] sections)"},
+	{section: "Delivery", key: "BreakerThreshold", env: "RELAY_DELIVERY_BREAKER_THRESHOLD", flag: "breaker-threshold", usage: "consecutive failures before a target is skipped"},
+	{section: "Delivery", key: "BreakerCooldown", env: "RELAY_DELIVERY_BREAKER_COOLDOWN", flag: "breaker-cooldown", usage: "how long a failing target is skipped"},
+	{section: "Delivery", key: "RecipientsPerMessage", env: "RELAY_DELIVERY_RECIPIENTS_PER_MESSAGE", flag: "recipients-per-message", usage: "recipients per copy before a message is split (0 disables)"},
+	{section: "Delivery", key: "Explode", env: "RELAY_DELIVERY_EXPLODE", flag: "explode", usage: "send every recipient a separate copy", isBool: true},
+	{section: "SMTPRelay", key: "Host", env: "RELAY_SMTP_RELAY_HOST", flag: "smtp-relay-host", usage: "smarthost for the smtp transport"},
+	{section: "SMTPRelay", key: "Port", env: "RELAY_SMTP_RELAY_PORT", flag: "smtp-relay-port", usage: "smarthost port"},
+	{section: "SMTPRelay", key: "Username", env: "RELAY_SMTP_RELAY_USERNAME", flag: "smtp-relay-username", usage: "smarthost username"},
+	{section: "SMTPRelay", key: "Password", env: "RELAY_SMTP_RELAY_PASSWORD", flag: "smtp-relay-password", usage: "smarthost password"},
+	{section: "SMTPRelay", key: "TLS", env: "RELAY_SMTP_RELAY_TLS", flag: "smtp-relay-tls", usage: "smarthost TLS mode: starttls, tls or none"},
+	{section: "SMTPRelay", key: "HeloName", env: "RELAY_SMTP_RELAY_HELO_NAME", flag: "smtp-relay-helo-name", usage: "name sent in EHLO to the smarthost"},
+	{section: "FileDrop", key: "Directory", env: "RELAY_FILE_DROP_DIRECTORY", flag: "file-drop-directory", usage: "output directory for the file transport"},
+	{section: "FileDrop", key: "Format", env: "RELAY_FILE_DROP_FORMAT", flag: "file-drop-format", usage: "file transport format: eml or maildir"},
+	{section: "Webhook", key: "URL", env: "RELAY_WEBHOOK_URL", flag: "webhook-url", usage: "endpoint for the webhook transport"},
+	{section: "Webhook", key: "Authorization", env: "RELAY_WEBHOOK_AUTHORIZATION", flag: "webhook-authorization", usage: "Authorization header sent to the webhook"},
+	{section: "Webhook", key: "Timeout", env: "RELAY_WEBHOOK_TIMEOUT", flag: "webhook-timeout", usage: "webhook request timeout"},
+}
+
+// configPathEnv names the environment variable that points at config.ini.
+const configPathEnv = "RELAY_CONFIG"
+
+// configPath is the config file to load and configPathExplicit reports whether
+// it was chosen by the user (and therefore must exist).
+var (
+	configPath         = "config.ini"
+	configPathExplicit bool
+)
+
+// flagOverrides holds the option values given on the command line, keyed by
+// "Section.Key".
+var flagOverrides = make(map[string]string)
+
+var flagSet *flag.FlagSet
+
+// optionValue is a flag.Value that records an override for a config option.
+type optionValue struct {
+	opt   configOption
+	value string
+}
+
+func (v *optionValue) String() string { return v.value }
+
+func (v *optionValue) Set(s string) error {
+	if v.opt.isBool {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+	}
+	v.value = s
+	flagOverrides[v.opt.section+"."+v.opt.key] = s
+	return nil
+}
+
+func (v *optionValue) IsBoolFlag() bool { return v.opt.isBool }
+
+// parseFlags parses the global flags that precede the subcommand and returns
+// the remaining arguments. It must run before initWorkingDir so relative paths
+// are resolved against the directory the user started us from.
+func parseFlags(args []string) ([]string, error) {
+	flagSet = flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+
+	path := flagSet.String("config", "", "path to config.ini (env "+configPathEnv+")")
+	for _, opt := range configOptions {
+		flagSet.Var(&optionValue{opt: opt}, opt.flag, fmt.Sprintf("%s (env %s)", opt.usage, opt.env))
+	}
+
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := resolveConfigPath(*path); err != nil {
+		return nil, err
+	}
+	return flagSet.Args(), nil
+}
+
+// resolveConfigPath chooses the config file given by -config or, without
+// it, by RELAY_CONFIG. Like parseFlags it must run before initWorkingDir.
+func resolveConfigPath(path string) error {
+	if path == "" {
+		path = os.Getenv(configPathEnv)
+	}
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("invalid config path %s: %w", path, err)
+		}
+		configPath = abs
+		configPathExplicit = true
+	}
+	return nil
+}
+
+// openConfigFile loads config.ini, or an empty configuration when the default
+// file is absent so the relay can run purely from environment and flags.
+func openConfigFile() (*ini.File, error) {
+	if _, err := os.Stat(configPath); err != nil {
+		if os.IsNotExist(err) && !configPathExplicit {
+			logger.Printf("No config file found at %s, using environment and flags only", configPath)
+			return ini.Empty(), nil
+		}
+		return nil, err
+	}
+	logger.Printf("Loading config from %s", configPath)
+	return ini.Load(configPath)
+}
+
+// applyOverrides writes environment and flag values into cfg so the typed
+// accessors in loadConfig see the final value regardless of its source.
+func applyOverrides(cfg *ini.File) {
+	for _, opt := range configOptions {
+		key := cfg.Section(opt.section).Key(opt.key)
+		if v, ok := os.LookupEnv(opt.env); ok {
+			key.SetValue(v)
+			logger.Printf("Config %s.%s overridden by environment (%s)", opt.section, opt.key, opt.env)
+		}
+		if v, ok := flagOverrides[opt.section+"."+opt.key]; ok {
+			key.SetValue(v)
+			logger.Printf("Config %s.%s overridden by flag -%s", opt.section, opt.key, opt.flag)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"gopkg.in/ini.v1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyOverridesPrecedence(t *testing.T) {
+	flagOverrides = make(map[string]string)
+	t.Cleanup(func() { flagOverrides = make(map[string]string) })
+
+	cfg, err := ini.Load([]byte("[MicrosoftGraph]\nTenantID = from-file\nClientID = from-file\nClientSecret = from-file\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_GRAPH_CLIENT_ID", "from-env")
+	t.Setenv("RELAY_GRAPH_CLIENT_SECRET", "from-env")
+	t.Setenv("RELAY_SERVER_SMTP_PORT", "2526")
+	if _, err := parseFlags([]string{"-graph-client-secret=from-flag", "-debug", "run"}); err != nil {
+		t.Fatal(err)
+	}
+	applyOverrides(cfg)
+
+	want := map[string]string{
+		"MicrosoftGraph.TenantID":     "from-file",
+		"MicrosoftGraph.ClientID":     "from-env",
+		"MicrosoftGraph.ClientSecret": "from-flag",
+		"Server.SMTPPort":             "2526",
+		"Service.Debug":               "true",
+	}
+	for name, value := range want {
+		section, key, _ := strings.Cut(name, ".")
+		if got := cfg.Section(section).Key(key).String(); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestApplyOverridesEmptyEnvironment(t *testing.T) {
+	// A variable that is set but empty still overrides the file
+	flagOverrides = make(map[string]string)
+	cfg, _ := ini.Load([]byte("[Server]\nHost = 10.0.0.1\n"))
+	t.Setenv("RELAY_SERVER_HOST", "")
+	applyOverrides(cfg)
+	if got := cfg.Section("Server").Key("Host").String(); got != "" {
+		t.Errorf("Host = %q, want empty", got)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	t.Cleanup(func() {
+		flagOverrides = make(map[string]string)
+		configPath, configPathExplicit = "config.ini", false
+	})
+
+	if _, err := parseFlags([]string{"-debug=maybe"}); err == nil {
+		t.Error("an invalid boolean was accepted")
+	}
+
+	dir := t.TempDir()
+	t.Setenv(configPathEnv, filepath.Join(dir, "env.ini"))
+	args, err := parseFlags([]string{"-port", "25", "check-config", "-x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || args[0] != "check-config" {
+		t.Errorf("remaining arguments = %q", args)
+	}
+	if configPath != filepath.Join(dir, "env.ini") || !configPathExplicit {
+		t.Errorf("config path = %s (explicit %v), want the one from %s", configPath, configPathExplicit, configPathEnv)
+	}
+	if flagOverrides["Server.SMTPPort"] != "25" {
+		t.Errorf("port override = %q", flagOverrides["Server.SMTPPort"])
+	}
+
+	// -config wins over the environment
+	if _, err := parseFlags([]string{"-config", filepath.Join(dir, "flag.ini")}); err != nil {
+		t.Fatal(err)
+	}
+	if configPath != filepath.Join(dir, "flag.ini") {
+		t.Errorf("config path = %s, want the -config one", configPath)
+	}
+
+	// An explicit path must exist; the default may be missing
+	if _, err := openConfigFile(); !os.IsNotExist(err) {
+		t.Errorf("missing explicit config: err = %v", err)
+	}
+	configPath, configPathExplicit = filepath.Join(dir, "config.ini"), false
+	if cfg, err := openConfigFile(); err != nil || len(cfg.Section("Server").Keys()) != 0 {
+		t.Errorf("missing default config: %v", err)
+	}
+}
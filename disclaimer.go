@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"html"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Disclaimers ---
+//
+// Each [Disclaimer.<name>] section defines a footer added to outgoing
+// bodies:
+//
+//	[Disclaimer.legal]
+//	SenderDomains = contoso.com
+//	Scope = external
+//	Text = This message is confidential. Sent by ${sender} on ${date}.
+//	HTMLFile = disclaimer.html
+//
+// The first section, in file order, whose SenderDomains (empty matches
+// every sender) and Scope match the message applies. The text is appended
+// to the plain-text body and the HTML is inserted before </body>. A body
+// that already carries the disclaimer, such as a reply quoting an earlier
+// message, is left alone.
+
+// Disclaimer is a parsed [Disclaimer.<name>] section.
+type Disclaimer struct {
+	Name          string
+	SenderDomains []string
+	Scope         string // "external", "internal" or "all"
+	Text          string
+	HTML          string
+}
+
+func loadDisclaimers(cfg *ini.File) ([]Disclaimer, error) {
+	var out []Disclaimer
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "Disclaimer.")
+		if !ok {
+			continue
+		}
+		d := Disclaimer{
+			Name:  name,
+			Scope: strings.ToLower(sec.Key("Scope").In("external", []string{"external", "internal", "all"})),
+			Text:  sec.Key("Text").String(),
+			HTML:  sec.Key("HTML").String(),
+		}
+		for _, dom := range sec.Key("SenderDomains").Strings(",") {
+			d.SenderDomains = append(d.SenderDomains, strings.ToLower(dom))
+		}
+		for key, dst := range map[string]*string{"TextFile": &d.Text, "HTMLFile": &d.HTML} {
+			path := sec.Key(key).String()
+			if path == "" {
+				continue
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("Disclaimer.%s: %w", name, err)
+			}
+			*dst = strings.TrimRight(string(b), "\r\n")
+		}
+		if d.Text == "" && d.HTML == "" {
+			return nil, fmt.Errorf("Disclaimer.%s has no Text, HTML, TextFile or HTMLFile", name)
+		}
+		if d.HTML == "" {
+			d.HTML = "<p>" + strings.ReplaceAll(html.EscapeString(d.Text), "\n", "<br>") + "</p>"
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// matches reports whether the disclaimer applies to a message from sender
+// to recipients.
+func (d *Disclaimer) matches(sender string, recipients []string) bool {
+	if len(d.SenderDomains) > 0 && !containsFold(d.SenderDomains, senderDomain(sender)) {
+		return false
+	}
+	if d.Scope == "all" {
+		return true
+	}
+	external := false
+	for _, rcpt := range recipients {
+		if !config.RecipientPolicy.isInternal(senderDomain(rcpt), sender) {
+			external = true
+			break
+		}
+	}
+	return external == (d.Scope == "external")
+}
+
+// expandDisclaimer replaces ${sender}, ${sender_domain}, ${subject} and
+// ${date} in a template; escape is applied to each value. Any other text,
+// such as "$5" or an unknown ${name}, is kept as written.
+func expandDisclaimer(template, sender, subject string, escape func(string) string) string {
+	values := map[string]string{
+		"sender":        sender,
+		"sender_domain": senderDomain(sender),
+		"subject":       subject,
+		"date":          time.Now().Format("2 January 2006"),
+	}
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if n := disclaimerVariable(template[i:]); n > 0 {
+			b.WriteString(escape(values[template[i+2:i+n-1]]))
+			i += n - 1
+			continue
+		}
+		b.WriteByte(template[i])
+	}
+	return b.String()
+}
+
+// disclaimerVariable returns the length of the ${name} of a known variable
+// at the start of s, or 0.
+func disclaimerVariable(s string) int {
+	if !strings.HasPrefix(s, "${") {
+		return 0
+	}
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return 0
+	}
+	switch s[2:end] {
+	case "sender", "sender_domain", "subject", "date":
+		return end + 1
+	}
+	return 0
+}
+
+// disclaimerMarker returns the longest stretch of fixed text in a template,
+// outside variables and HTML tags, used to recognise a body that carries
+// the disclaimer, also when quoted in a reply sent by someone else.
+func disclaimerMarker(template string) string {
+	var longest, current strings.Builder
+	flush := func() {
+		if t := strings.TrimSpace(current.String()); len(t) > longest.Len() {
+			longest.Reset()
+			longest.WriteString(t)
+		}
+		current.Reset()
+	}
+	for i := 0; i < len(template); i++ {
+		if n := disclaimerVariable(template[i:]); n > 0 {
+			flush()
+			i += n - 1
+			continue
+		}
+		switch c := template[i]; c {
+		case '<':
+			// Skip the tag
+			flush()
+			for i < len(template) && template[i] != '>' {
+				i++
+			}
+		case '\n':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return longest.String()
+}
+
+// carriesDisclaimer reports whether body contains the disclaimer expanded
+// from template, or the template's fixed text.
+func carriesDisclaimer(body, template, expanded string) bool {
+	if t := strings.TrimSpace(expanded); t != "" && strings.Contains(body, t) {
+		return true
+	}
+	marker := disclaimerMarker(template)
+	return marker != "" && strings.Contains(body, marker)
+}
+
+// applyDisclaimer adds the first matching disclaimer to the bodies. A
+// message without a body gets the disclaimer as its body.
+func applyDisclaimer(sender, subject string, recipients []string, textBody, htmlBody string) (string, string) {
+	for i := range config.Disclaimers {
+		d := &config.Disclaimers[i]
+		if !d.matches(sender, recipients) {
+			continue
+		}
+
+		empty := textBody == "" && htmlBody == ""
+		applied := false
+		if (textBody != "" || empty) && d.Text != "" {
+			footer := expandDisclaimer(d.Text, sender, subject, func(s string) string { return s })
+			if carriesDisclaimer(textBody, d.Text, footer) {
+				debugLog("Disclaimer %s already present in text body", d.Name)
+			} else {
+				footer += "\r\n"
+				if textBody != "" {
+					footer = strings.TrimRight(textBody, "\r\n") + "\r\n\r\n" + footer
+				}
+				textBody = footer
+				applied = true
+			}
+		}
+		if htmlBody != "" || empty && d.Text == "" {
+			// The comment survives most clients; the text catches quoted
+			// copies that lost it
+			tag := "<!-- disclaimer:" + d.Name + " -->"
+			footer := expandDisclaimer(d.HTML, sender, subject, html.EscapeString)
+			if strings.Contains(htmlBody, tag) || carriesDisclaimer(htmlBody, d.HTML, footer) {
+				debugLog("Disclaimer %s already present in HTML body", d.Name)
+			} else {
+				htmlBody = insertBeforeBodyEnd(htmlBody, tag+footer)
+				applied = true
+			}
+		}
+		if applied {
+			logger.Printf("Disclaimer %s added to message from %s", d.Name, sender)
+		}
+		return textBody, htmlBody
+	}
+	return textBody, htmlBody
+}
+
+// insertBeforeBodyEnd inserts fragment before the closing </body> tag of an
+// HTML document, or appends it when there is none.
+func insertBeforeBodyEnd(htmlBody, fragment string) string {
+	if i := strings.LastIndex(strings.ToLower(htmlBody), "</body>"); i >= 0 {
+		return htmlBody[:i] + fragment + htmlBody[i:]
+	}
+	return htmlBody + fragment
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"gopkg.in/ini.v1"
+	"strings"
+	"testing"
+)
+
+// useDisclaimers loads the disclaimers of an ini document into config.
+func useDisclaimers(t *testing.T, source string) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	cfg, err := ini.Load([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Disclaimers, err = loadDisclaimers(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyDisclaimerIdempotent(t *testing.T) {
+	useDisclaimers(t, `[Disclaimer.legal]
+Scope = all
+Text = This message is confidential. Sent by ${sender}.
+HTML = <p class="legal">This message is <b>confidential</b>. Sent by ${sender}.</p>
+`)
+	sender, rcpts := "alice@contoso.com", []string{"bob@fabrikam.com"}
+
+	text, htm := applyDisclaimer(sender, "Hi", rcpts, "Hello\r\n", "<html><body><p>Hello</p></body></html>")
+	if want := "Hello\r\n\r\nThis message is confidential. Sent by alice@contoso.com.\r\n"; text != want {
+		t.Errorf("text = %q, want %q", text, want)
+	}
+	if !strings.Contains(htm, "Sent by alice@contoso.com.</p></body>") {
+		t.Errorf("html = %q, want the disclaimer before </body>", htm)
+	}
+
+	// Relaying the stamped message again changes nothing
+	text2, htm2 := applyDisclaimer(sender, "Hi", rcpts, text, htm)
+	if text2 != text || htm2 != htm {
+		t.Errorf("second pass changed the bodies:\n%q\n%q", text2, htm2)
+	}
+
+	// A reply quoting the message, sent by someone else, is not stamped
+	// again, even after the client dropped the HTML comment
+	quoted := "Thanks!\r\n\r\n> Hello\r\n> This message is confidential. Sent by alice@contoso.com.\r\n"
+	quotedHTML := "<html><body>Thanks!<blockquote>" + strings.ReplaceAll(htm, "<!-- disclaimer:legal -->", "") + "</blockquote></body></html>"
+	if text3, htm3 := applyDisclaimer("carol@contoso.com", "Re: Hi", rcpts, quoted, quotedHTML); text3 != quoted || htm3 != quotedHTML {
+		t.Errorf("quoted reply was stamped again:\n%q\n%q", text3, htm3)
+	}
+}
+
+func TestDisclaimerMatches(t *testing.T) {
+	useDisclaimers(t, `[Disclaimer.external]
+SenderDomains = contoso.com
+Text = External footer
+[Disclaimer.internal]
+Scope = internal
+Text = Internal footer
+`)
+	footer := func(sender string, rcpts ...string) string {
+		text, _ := applyDisclaimer(sender, "", rcpts, "Body", "")
+		_, f, _ := strings.Cut(text, "\r\n\r\n")
+		return strings.TrimSpace(f)
+	}
+	if got := footer("alice@contoso.com", "bob@contoso.com", "x@fabrikam.com"); got != "External footer" {
+		t.Errorf("external recipient: footer %q", got)
+	}
+	if got := footer("alice@contoso.com", "bob@contoso.com"); got != "Internal footer" {
+		t.Errorf("internal recipients: footer %q", got)
+	}
+	if got := footer("eve@fabrikam.com", "x@northwind.com"); got != "" {
+		t.Errorf("other sender domain to external: footer %q, want none", got)
+	}
+}
+
+func TestDisclaimerMarker(t *testing.T) {
+	for template, want := range map[string]string{
+		"Sent by ${sender} on ${date}. Confidential and privileged.": ". Confidential and privileged.",
+		"<p>Short</p><p>The longest fixed text</p>":                  "The longest fixed text",
+		"${sender}":                      "",
+		"Line one\nand line two, longer": "and line two, longer",
+	} {
+		if got := disclaimerMarker(template); got != want {
+			t.Errorf("disclaimerMarker(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestExpandDisclaimer(t *testing.T) {
+	upper := strings.ToUpper
+	for template, want := range map[string]string{
+		"Sent by ${sender} (${sender_domain}) re ${subject}": "Sent by ALICE@CONTOSO.COM (CONTOSO.COM) re Q3 <DRAFT>",
+		"Calls cost $5 per minute, $HOME is not expanded":    "Calls cost $5 per minute, $HOME is not expanded",
+		"Unknown ${name} and unclosed ${sender":              "Unknown ${name} and unclosed ${sender",
+		"$${sender}$":                                        "$ALICE@CONTOSO.COM$",
+	} {
+		if got := expandDisclaimer(template, "alice@contoso.com", "Q3 <draft>", upper); got != want {
+			t.Errorf("expandDisclaimer(%q) = %q, want %q", template, got, want)
+		}
+	}
+}
+
+func TestApplyDisclaimerVariablesOnly(t *testing.T) {
+	// Nothing but variables: there is no fixed text, but the expanded
+	// disclaimer tells a stamped body apart
+	useDisclaimers(t, "[Disclaimer.sig]\nScope = all\nText = ${sender}\n")
+	text, _ := applyDisclaimer("alice@contoso.com", "", nil, "Hello", "")
+	if text != "Hello\r\n\r\nalice@contoso.com\r\n" {
+		t.Fatalf("text = %q", text)
+	}
+	if again, _ := applyDisclaimer("alice@contoso.com", "", nil, text, ""); again != text {
+		t.Errorf("stamped twice: %q", again)
+	}
+	if other, _ := applyDisclaimer("bob@contoso.com", "", nil, text, ""); !strings.HasSuffix(other, "bob@contoso.com\r\n") {
+		t.Errorf("forwarded by another sender: %q, want their disclaimer", other)
+	}
+}
+
+func TestApplyDisclaimerEmptyBody(t *testing.T) {
+	useDisclaimers(t, "[Disclaimer.text]\nScope = all\nSenderDomains = contoso.com\nText = Footer\n"+
+		"[Disclaimer.html]\nScope = all\nHTML = <p>Footer</p>\n")
+
+	text, htm := applyDisclaimer("alice@contoso.com", "", nil, "", "")
+	if text != "Footer\r\n" || htm != "" {
+		t.Errorf("text disclaimer on empty message: %q, %q", text, htm)
+	}
+	text, htm = applyDisclaimer("bob@fabrikam.com", "", nil, "", "")
+	if text != "" || htm != "<!-- disclaimer:html --><p>Footer</p>" {
+		t.Errorf("HTML disclaimer on empty message: %q, %q", text, htm)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Dry Run ---
+//
+// In dry-run mode sendMail writes the request it would have made to
+// DryRunDirectory/<id>/request.json instead of calling Graph. Attachment
+// contents are decoded into DryRunDirectory/<id>/attachments/ and replaced in
+// the JSON body by a reference to the file. Messages sent as MIME are
+// written to DryRunDirectory/<id>/message.eml.
+
+// dryRunRequest is the on-disk form of a Graph request that was not sent.
+type dryRunRequest struct {
+	Method string                 `json:"method"`
+	URL    string                 `json:"url"`
+	Sender string                 `json:"sender"`
+	Body   map[string]interface{} `json:"body"`
+}
+
+func writeDryRun(sender string, payload map[string]interface{}, attachments []Attachment) (*DeliveryResult, error) {
+	start := time.Now()
+	id := fmt.Sprintf("%s-%s", start.UTC().Format("20060102T150405"), uuid.New().String()[:8])
+	dir := filepath.Join(config.DryRunDirectory, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create dry-run directory: %w", err)
+	}
+
+	// Work on copies so the caller's payload is left untouched.
+	body := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		body[k] = v
+	}
+	msg, _ := payload["message"].(map[string]interface{})
+	msgCopy := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		msgCopy[k] = v
+	}
+	body["message"] = msgCopy
+
+	saved := []map[string]interface{}{}
+	for i, a := range attachments {
+		file := fmt.Sprintf("%02d-%s", i+1, sanitizeFilename(a.Name))
+		if err := os.MkdirAll(filepath.Join(dir, "attachments"), 0700); err != nil {
+			return nil, err
+		}
+		if err := saveAttachment(filepath.Join(dir, "attachments", file), a); err != nil {
+			return nil, fmt.Errorf("failed to write attachment %q: %w", a.Name, err)
+		}
+		meta := graphAttachmentMeta(a)
+		meta["contentBytes"] = "@file:attachments/" + file
+		saved = append(saved, meta)
+	}
+	msgCopy["attachments"] = saved
+
+	request := dryRunRequest{
+		Method: "POST",
+		URL:    sendMailURL(sender),
+		Sender: sender,
+		Body:   body,
+	}
+	data, err := json.MarshalIndent(request, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "request.json"), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write dry-run request: %w", err)
+	}
+
+	subject, _ := msg["subject"].(string)
+	recipients := 0
+	for _, field := range []string{"toRecipients", "ccRecipients", "bccRecipients"} {
+		if list, ok := msg[field].([]map[string]interface{}); ok {
+			recipients += len(list)
+		}
+	}
+	logger.Printf("Dry run: message from %s to %d recipient(s), subject %q, %d attachment(s) written to %s",
+		sender, recipients, subject, len(attachments), dir)
+
+	return &DeliveryResult{RequestID: "dry-run-" + id, Attempts: 1, Duration: time.Since(start)}, nil
+}
+
+// writeDryRunMIME writes a message that would have been sent as MIME to
+// DryRunDirectory/<id>/message.eml.
+func writeDryRunMIME(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	start := time.Now()
+	id := fmt.Sprintf("%s-%s", start.UTC().Format("20060102T150405"), uuid.New().String()[:8])
+	dir := filepath.Join(config.DryRunDirectory, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create dry-run directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "message.eml"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = renderMessage(f, env, msg)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write dry-run message: %w", err)
+	}
+	logger.Printf("Dry run: MIME message from %s to %d recipient(s), subject %q, written to %s",
+		env.From, len(allRecipients(msg)), msg.Subject, dir)
+
+	return &DeliveryResult{RequestID: "dry-run-" + id, Attempts: 1, Duration: time.Since(start)}, nil
+}
+
+func saveAttachment(path string, a Attachment) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = copyAttachment(f, a)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sanitizeFilename makes an attachment name safe to use as a file name.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		name = "attachment"
+	}
+	return name
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/emersion/go-smtp"
+	"strings"
+)
+
+// --- Delivery Status Notifications ---
+//
+// With [NDR] Postmaster set, the relay advertises the DSN extension (RFC
+// 3461). The ENVID and RET parameters of MAIL FROM and the NOTIFY and ORCPT
+// parameters of each RCPT TO are kept with the message, also when it moves
+// to the spool, and decide which delivery reports ndr.go sends:
+//
+//	NOTIFY=SUCCESS  once the delivery transport accepted the message
+//	NOTIFY=FAILURE  once the relay gives up on it (the default)
+//	NOTIFY=DELAY    when a first attempt failed and it is retried from the spool
+//	NOTIFY=NEVER    no reports at all
+//
+// RET=FULL returns the whole message with a report instead of its header.
+
+// recipientDSN holds the DSN parameters of one RCPT TO.
+type recipientDSN struct {
+	Notify   []string `json:"notify,omitempty"`   // NEVER, or any of SUCCESS, FAILURE and DELAY
+	Original string   `json:"original,omitempty"` // ORCPT as "<type>; <address>"
+}
+
+// messageDSN holds the DSN parameters of a message. Recipients are keyed by
+// their lower-case address, after alias expansion.
+type messageDSN struct {
+	EnvelopeID string                  `json:"envid,omitempty"`
+	Return     string                  `json:"ret,omitempty"` // FULL or HDRS
+	Recipients map[string]recipientDSN `json:"recipients,omitempty"`
+}
+
+// setMail records the DSN parameters of MAIL FROM.
+func (d *messageDSN) setMail(opts *smtp.MailOptions) {
+	if opts == nil {
+		return
+	}
+	d.EnvelopeID = opts.EnvelopeID
+	d.Return = string(opts.Return)
+}
+
+// setRecipient records the DSN parameters of a RCPT TO for each address it
+// was expanded to.
+func (d *messageDSN) setRecipient(addresses []string, opts *smtp.RcptOptions) {
+	if opts == nil || len(opts.Notify) == 0 && opts.OriginalRecipient == "" {
+		return
+	}
+	r := recipientDSN{}
+	for _, n := range opts.Notify {
+		r.Notify = append(r.Notify, string(n))
+	}
+	if opts.OriginalRecipient != "" {
+		r.Original = strings.ToLower(string(opts.OriginalRecipientType)) + "; " + opts.OriginalRecipient
+	}
+	if d.Recipients == nil {
+		d.Recipients = make(map[string]recipientDSN)
+	}
+	for _, addr := range addresses {
+		d.Recipients[strings.ToLower(addr)] = r
+	}
+}
+
+// empty reports whether the client gave no DSN parameters.
+func (d *messageDSN) empty() bool {
+	return d == nil || d.EnvelopeID == "" && d.Return == "" && len(d.Recipients) == 0
+}
+
+// wants reports whether rcpt asked to be notified of event. Without NOTIFY
+// only failures are reported.
+func (d *messageDSN) wants(rcpt string, event smtp.DSNNotify) bool {
+	var r recipientDSN
+	if d != nil {
+		r = d.Recipients[strings.ToLower(rcpt)]
+	}
+	if len(r.Notify) == 0 {
+		return event == smtp.DSNNotifyFailure
+	}
+	return containsFold(r.Notify, string(event))
+}
+
+// reportRecipients returns the report entries for the recipients that
+// asked to be notified of event.
+func (d *messageDSN) reportRecipients(recipients []string, event smtp.DSNNotify, action, status, diagnostic string) []reportRecipient {
+	var list []reportRecipient
+	for _, rcpt := range recipients {
+		if !d.wants(rcpt, event) {
+			continue
+		}
+		r := reportRecipient{address: rcpt, action: action, status: status, diagnostic: diagnostic}
+		if d != nil {
+			r.original = d.Recipients[strings.ToLower(rcpt)].Original
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+// sendSuccessDSN reports a message the transport accepted to the
+// recipients that asked for NOTIFY=SUCCESS. The relay cannot see the final
+// delivery, so the action is "relayed".
+func sendSuccessDSN(returnPath string, recipients []string, path string, dsn *messageDSN) {
+	list := dsn.reportRecipients(recipients, smtp.DSNNotifySuccess, "relayed", "2.0.0", "")
+	if err := sendDeliveryReport(returnPath, path, dsn, list); err != nil {
+		logger.Printf("Failed to send delivery report to %s: %v", returnPath, err)
+	}
+}
+
+// sendDelayDSN reports a message that failed temporarily and will be
+// retried to the recipients that asked for NOTIFY=DELAY.
+func sendDelayDSN(returnPath string, recipients []string, path string, dsn *messageDSN, cause error) {
+	status, diagnostic := errorStatus(cause, 4)
+	list := dsn.reportRecipients(recipients, smtp.DSNNotifyDelayed, "delayed", status, diagnostic)
+	if err := sendDeliveryReport(returnPath, path, dsn, list); err != nil {
+		logger.Printf("Failed to send delay report to %s: %v", returnPath, err)
+	}
+}
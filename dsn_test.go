@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/emersion/go-smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageDSNWants(t *testing.T) {
+	d := &messageDSN{}
+	d.setRecipient([]string{"Success@contoso.com"}, &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}})
+	d.setRecipient([]string{"never@contoso.com", "never2@contoso.com"}, &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}})
+	d.setRecipient([]string{"orcpt@contoso.com"}, &smtp.RcptOptions{OriginalRecipientType: smtp.DSNAddressTypeRFC822, OriginalRecipient: "list@contoso.com"})
+
+	for _, tt := range []struct {
+		rcpt  string
+		event smtp.DSNNotify
+		want  bool
+	}{
+		{"success@contoso.com", smtp.DSNNotifySuccess, true},
+		{"success@contoso.com", smtp.DSNNotifyDelayed, false},
+		{"never2@contoso.com", smtp.DSNNotifyFailure, false},
+		{"orcpt@contoso.com", smtp.DSNNotifyFailure, true}, // Default: failures only
+		{"orcpt@contoso.com", smtp.DSNNotifySuccess, false},
+		{"other@contoso.com", smtp.DSNNotifyFailure, true},
+	} {
+		if got := d.wants(tt.rcpt, tt.event); got != tt.want {
+			t.Errorf("wants(%s, %s) = %v, want %v", tt.rcpt, tt.event, got, tt.want)
+		}
+	}
+	if got := d.Recipients["orcpt@contoso.com"].Original; got != "rfc822; list@contoso.com" {
+		t.Errorf("ORCPT = %q", got)
+	}
+	var none *messageDSN
+	if !none.empty() || !none.wants("x@y", smtp.DSNNotifyFailure) {
+		t.Error("a nil messageDSN must be empty and report failures")
+	}
+}
+
+// reportRecorder records reports and the delivery-status part of each,
+// which is removed once the report is sent.
+type reportRecorder struct {
+	recordingTransport
+	statuses []string
+}
+
+func (r *reportRecorder) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	if len(msg.Attachments) > 0 {
+		status, _ := os.ReadFile(msg.Attachments[0].path)
+		r.statuses = append(r.statuses, string(status))
+	}
+	return r.recordingTransport.Send(env, msg)
+}
+
+// reportTransport makes a report recorder the active transport and sets a
+// postmaster, so delivery reports are sent to it.
+func reportTransport(t *testing.T) *reportRecorder {
+	t.Helper()
+	savedTransport, savedConfig := activeTransport, config
+	t.Cleanup(func() { activeTransport, config = savedTransport, savedConfig })
+	rec := &reportRecorder{}
+	activeTransport = rec
+	config.Postmaster = "postmaster@contoso.com"
+	return rec
+}
+
+func writeMessage(t *testing.T, header string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "message.eml")
+	if err := os.WriteFile(path, []byte(header+"\r\nBody\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDeliveryReportSuppressed(t *testing.T) {
+	failed := []reportRecipient{{address: "bob@fabrikam.com", action: "failed", status: "5.1.1"}}
+	plain := "From: alice@contoso.com\r\nSubject: Hi\r\n"
+
+	for name, tc := range map[string]struct {
+		returnPath string
+		header     string
+	}{
+		"null sender":     {"", plain},
+		"null sender <>":  {"<>", plain},
+		"from postmaster": {"Postmaster@Contoso.com", plain},
+		"auto-generated":  {"alice@contoso.com", plain + "Auto-Submitted: auto-generated\r\n"},
+		"auto-replied":    {"alice@contoso.com", plain + "Auto-Submitted: auto-replied\r\n"},
+		"report message":  {"alice@contoso.com", plain + "Content-Type: multipart/report; report-type=delivery-status; boundary=x\r\n"},
+		"nothing to tell": {"alice@contoso.com", plain},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := reportTransport(t)
+			list := failed
+			if name == "nothing to tell" {
+				list = nil
+			}
+			if err := sendDeliveryReport(tc.returnPath, writeMessage(t, tc.header), nil, list); err != nil {
+				t.Fatal(err)
+			}
+			if len(rec.copies) != 0 {
+				t.Errorf("a report was sent: %+v", rec.copies[0])
+			}
+		})
+	}
+}
+
+func TestDeliveryReportSent(t *testing.T) {
+	rec := reportTransport(t)
+	path := writeMessage(t, "From: alice@contoso.com\r\nSubject: Hi\r\nMessage-Id: <1@contoso.com>\r\nAuto-Submitted: no\r\n")
+	dsn := &messageDSN{EnvelopeID: "env-1", Return: string(smtp.DSNReturnFull)}
+	list := []reportRecipient{{address: "bob@fabrikam.com", action: "failed", status: "5.1.1", original: "rfc822; team@contoso.com"}}
+
+	if err := sendDeliveryReport("<alice@contoso.com>", path, dsn, list); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.copies) != 1 {
+		t.Fatalf("sent %d reports, want 1", len(rec.copies))
+	}
+	report := rec.copies[0]
+	if strings.Join(report.To, ",") != "alice@contoso.com" || report.ReportType != "delivery-status" {
+		t.Errorf("report to %v, type %q", report.To, report.ReportType)
+	}
+	if report.Header.Get("In-Reply-To") != "<1@contoso.com>" {
+		t.Errorf("In-Reply-To = %q", report.Header.Get("In-Reply-To"))
+	}
+	if len(report.Attachments) != 2 || report.Attachments[1].ContentType != "message/rfc822" {
+		t.Fatalf("attachments = %+v, want the status and the full message", report.Attachments)
+	}
+	status := rec.statuses[0]
+	for _, want := range []string{"Original-Envelope-Id: env-1", "Original-Recipient: rfc822; team@contoso.com", "Final-Recipient: rfc822; bob@fabrikam.com", "Status: 5.1.1"} {
+		if !strings.Contains(status, want) {
+			t.Errorf("status lacks %q:\n%s", want, status)
+		}
+	}
+}
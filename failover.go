@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Delivery Failover ---
+
+// circuitBreaker stops sending to a target after repeated temporary
+// failures. Once the cooldown has passed a single trial delivery is let
+// through; its outcome closes or re-opens the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a delivery may be attempted now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true // half-open: let one delivery through
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a temporary failure and reports whether the breaker opened.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+type deliveryTarget struct {
+	name      string
+	transport Transport
+	breaker   *circuitBreaker
+}
+
+// failoverTransport tries an ordered list of targets, moving on to the next
+// one after a temporary failure. Permanent failures are returned at once,
+// because another target would reject the message for the same reason.
+type failoverTransport struct {
+	targets []*deliveryTarget
+}
+
+func (t *failoverTransport) Name() string {
+	var names []string
+	for _, target := range t.targets {
+		names = append(names, target.name)
+	}
+	return "failover(" + strings.Join(names, ",") + ")"
+}
+
+func (t *failoverTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	// A breaker is only asked when its target is about to be tried, as a
+	// half-open breaker expects the outcome of the delivery it lets through
+	var errs []string
+	for _, target := range t.targets {
+		if !target.breaker.allow() {
+			logger.Printf("Skipping delivery target %s: circuit breaker open", target.name)
+			continue
+		}
+		result, err := t.try(target, env, msg)
+		if err == nil || !isTemporary(err) {
+			return result, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", target.name, err))
+	}
+	if len(errs) == 0 {
+		// Every breaker is open. The message waits for a retry; the trial
+		// a breaker lets through after its cooldown is the only probe.
+		return nil, &DeliveryError{Err: fmt.Errorf("circuit breaker open for every delivery target"), Temporary: true}
+	}
+
+	return nil, &DeliveryError{
+		Err:       fmt.Errorf("all delivery targets failed: %s", strings.Join(errs, "; ")),
+		Temporary: true,
+	}
+}
+
+// try sends msg to target and records the outcome in its breaker.
+func (t *failoverTransport) try(target *deliveryTarget, env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	result, err := target.transport.Send(env, msg)
+	if err == nil {
+		target.breaker.success()
+		result.Transport = target.name
+		logger.Printf("Message from %s delivered by target %s (%s)", env.From, target.name, target.transport.Name())
+		return result, nil
+	}
+
+	if !isTemporary(err) {
+		// The message was refused, so the target is up
+		target.breaker.success()
+		logger.Printf("Delivery target %s rejected the message permanently: %v", target.name, err)
+		return nil, err
+	}
+
+	if target.breaker.failure() {
+		logger.Printf("Circuit breaker for target %s opened for %v after %d failures", target.name, target.breaker.cooldown, target.breaker.threshold)
+	}
+	logger.Printf("Delivery target %s failed, failing over: %v", target.name, err)
+	return nil, err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// breakerStep is an operation on a circuit breaker and, for allow and
+// failure, the result it should return.
+type breakerStep struct {
+	op   string // allow, success, failure or expire (end the cooldown)
+	want bool
+}
+
+func runBreaker(t *testing.T, b *circuitBreaker, steps ...breakerStep) {
+	t.Helper()
+	for i, s := range steps {
+		var got bool
+		switch s.op {
+		case "allow":
+			got = b.allow()
+		case "success":
+			b.success()
+		case "failure":
+			got = b.failure()
+		case "expire":
+			b.openUntil = time.Now().Add(-time.Second)
+		default:
+			t.Fatalf("unknown step %q", s.op)
+		}
+		if got != s.want {
+			t.Fatalf("step %d (%s) = %v, want %v", i, s.op, got, s.want)
+		}
+	}
+}
+
+var (
+	allowed  = breakerStep{"allow", true}
+	refused  = breakerStep{"allow", false}
+	succeed  = breakerStep{"success", false}
+	fail     = breakerStep{"failure", false}
+	failOpen = breakerStep{"failure", true} // The failure opens the breaker
+	expire   = breakerStep{"expire", false}
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	newBreaker := func() *circuitBreaker { return &circuitBreaker{threshold: 2, cooldown: time.Hour} }
+
+	t.Run("closed", func(t *testing.T) {
+		runBreaker(t, newBreaker(), allowed, fail, allowed, succeed, fail, allowed)
+	})
+	t.Run("opens at threshold", func(t *testing.T) {
+		runBreaker(t, newBreaker(), fail, failOpen, refused, refused)
+	})
+	t.Run("one trial after the cooldown", func(t *testing.T) {
+		runBreaker(t, newBreaker(), fail, failOpen, expire, allowed, refused, refused)
+	})
+	t.Run("trial success closes", func(t *testing.T) {
+		runBreaker(t, newBreaker(), fail, failOpen, expire, allowed, succeed, allowed, allowed, fail, allowed)
+	})
+	t.Run("trial failure re-opens", func(t *testing.T) {
+		runBreaker(t, newBreaker(), fail, failOpen, expire, allowed, failOpen, refused, expire, allowed, refused)
+	})
+}
+
+// scriptedTransport returns its errors in turn, then succeeds, and counts
+// the deliveries it was given.
+type scriptedTransport struct {
+	errs  []error
+	calls int
+}
+
+func (s *scriptedTransport) Name() string { return "scripted" }
+
+func (s *scriptedTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DeliveryResult{}, nil
+}
+
+var errUnavailable = &DeliveryError{Err: errors.New("service unavailable"), Temporary: true}
+
+// failoverTrial opens the breaker of a primary target, lets the trial
+// delivery after the cooldown end with trial and reports whether the
+// message after that was offered to the primary again.
+func failoverTrial(t *testing.T, trial error) (primaryAgain bool, trialErr error) {
+	t.Helper()
+	primary := &scriptedTransport{errs: []error{errUnavailable, errUnavailable, trial}}
+	ft := &failoverTransport{targets: []*deliveryTarget{
+		{name: "primary", transport: primary, breaker: &circuitBreaker{threshold: 2, cooldown: time.Hour}},
+		{name: "secondary", transport: &scriptedTransport{}, breaker: &circuitBreaker{threshold: 2, cooldown: time.Hour}},
+	}}
+	send := func() (*DeliveryResult, error) {
+		return ft.Send(&Envelope{From: "app@contoso.com", To: []string{"ops@contoso.com"}}, &OutboundMessage{})
+	}
+
+	for i := 0; i < 2; i++ {
+		if result, err := send(); err != nil || result.Transport != "secondary" {
+			t.Fatalf("message %d: %v, %+v; want failover to secondary", i, err, result)
+		}
+	}
+	if _, err := send(); err != nil || primary.calls != 2 {
+		t.Fatalf("open breaker: err %v, primary called %d times, want 2", err, primary.calls)
+	}
+
+	ft.targets[0].breaker.openUntil = time.Now().Add(-time.Second)
+	_, trialErr = send()
+	if primary.calls != 3 {
+		t.Fatal("trial not sent to the primary")
+	}
+	send()
+	return primary.calls == 4, trialErr
+}
+
+func TestFailoverTrialDelivered(t *testing.T) {
+	if again, err := failoverTrial(t, nil); err != nil || !again {
+		t.Errorf("trial error %v, primary used again %v; want nil, true", err, again)
+	}
+}
+
+func TestFailoverTrialFailed(t *testing.T) {
+	// The secondary takes the message, the primary stays open
+	if again, err := failoverTrial(t, errUnavailable); err != nil || again {
+		t.Errorf("trial error %v, primary used again %v; want nil, false", err, again)
+	}
+}
+
+func TestFailoverTrialRejected(t *testing.T) {
+	// A permanent rejection shows the target is up; the breaker must not
+	// stay half-open with its trial outstanding
+	rejected := &DeliveryError{Err: errors.New("mailbox unavailable")}
+	again, err := failoverTrial(t, rejected)
+	if !errors.Is(err, rejected) {
+		t.Errorf("trial error = %v, want the rejection", err)
+	}
+	if !again {
+		t.Error("primary not used again after rejecting the trial")
+	}
+}
+
+func TestFailoverAllOpen(t *testing.T) {
+	only := &scriptedTransport{errs: []error{errUnavailable, errUnavailable}}
+	ft := &failoverTransport{targets: []*deliveryTarget{
+		{name: "only", transport: only, breaker: &circuitBreaker{threshold: 2, cooldown: time.Hour}},
+	}}
+	env := &Envelope{From: "app@contoso.com", To: []string{"ops@contoso.com"}}
+	for i := 0; i < 2; i++ {
+		ft.Send(env, &OutboundMessage{})
+	}
+
+	// With the breaker open the target is left alone
+	for i := 0; i < 3; i++ {
+		if _, err := ft.Send(env, &OutboundMessage{}); err == nil || !isTemporary(err) {
+			t.Fatalf("send with every breaker open: err = %v, want a temporary error", err)
+		}
+	}
+	if only.calls != 2 {
+		t.Fatalf("target called %d times, want 2: an open breaker must not be bypassed", only.calls)
+	}
+
+	// After the cooldown the trial is the only message let through
+	ft.targets[0].breaker.openUntil = time.Now().Add(-time.Second)
+	ft.targets[0].breaker.allow()
+	if _, err := ft.Send(env, &OutboundMessage{}); err == nil || only.calls != 2 {
+		t.Errorf("send while the trial is outstanding: err %v, %d calls", err, only.calls)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// Windows locks byte ranges and keeps other processes from reading a locked
+// range, so the lock is taken on a byte far beyond the end of any file.
+const lockOffsetHigh = 0x7fffffff
+
+// lockFile waits for an exclusive lock on f that other processes honour.
+func lockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+}
+
+func unlockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
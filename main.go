@@ -1,20 +1,23 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
 	"github.com/google/uuid"
 	"golang.org/x/text/encoding/charmap"
-	"gopkg.in/ini.v1"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,8 +34,77 @@ type Config struct {
 	Scope        string
 	Host         string
 	Port         string
-	ServiceName  string
-	Debug        bool
+
+	MaxMessageBytes     int64
+	MaxRecipients       int
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	TempDirectory       string // Message data and attachments in flight; empty is the system default
+	MemoryBudget        int64  // Bytes of message bodies held in memory at once; 0 is unlimited
+
+	ServiceName string
+	Debug       bool
+
+	SpoolDirectory    string
+	SpoolPollInterval time.Duration
+	SpoolMaxAttempts  int
+	SendmailDelivery  string // "direct" or "spool"
+
+	DryRun          bool
+	DryRunDirectory string
+
+	Tenants []TenantConfig // Per-domain app registrations; empty means [MicrosoftGraph] only
+
+	RecipientPolicy  RecipientPolicy
+	AttachmentPolicy AttachmentPolicy
+
+	QuarantineDirectory string
+	QuarantineRetention time.Duration // 0 keeps quarantined messages until they are deleted
+
+	Scanner ScannerConfig
+
+	Disclaimers []Disclaimer
+
+	RulesFile string
+
+	Postmaster string // Mailbox delivery reports are sent from; empty sends none
+
+	AuditFile string // JSON Lines audit log of every message; empty disables it
+
+	Milters             []string // Milter addresses, consulted in order
+	MilterDefaultAction string   // "accept", "tempfail" or "reject" when a milter fails
+	MilterTimeout       time.Duration
+
+	AliasesFile    string
+	RewriteMapFile string
+	DefaultSender  string // Used when a message has no usable sender
+
+	ValidateSenders   bool
+	SenderPositiveTTL time.Duration
+	SenderNegativeTTL time.Duration
+
+	Delivery         TransportConfig
+	Targets          []TransportConfig // Ordered failover targets; empty means Delivery only
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	RecipientsPerMessage int  // Larger messages are sent as several copies; 0 disables
+	Explode              bool // Send every recipient a copy of their own
+}
+
+// GraphCredentials identifies an app registration used to call Graph.
+type GraphCredentials struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+}
+
+// graphCredentials returns the app registration from [MicrosoftGraph].
+func (c Config) graphCredentials() GraphCredentials {
+	return GraphCredentials{TenantID: c.TenantID, ClientID: c.ClientID, ClientSecret: c.ClientSecret, Scope: c.Scope}
 }
 
 var config Config
@@ -73,6 +145,9 @@ func (tm *TransactionManager) cleanup() {
 		now := time.Now()
 		for key, timeout := range tm.timeouts {
 			if now.Sub(timeout) > 5*time.Minute {
+				if trans, exists := tm.transactions[key]; exists {
+					trans.discardData()
+				}
 				delete(tm.transactions, key)
 				delete(tm.timeouts, key)
 				logger.Printf("Cleaned up abandoned transaction: %s", key)
@@ -95,6 +170,7 @@ func (tm *TransactionManager) startCleanupRoutine() {
 					if trans, exists := tm.transactions[key]; exists {
 						logger.Printf("Cleaning up abandoned transaction: From=%s, Recipients=%d",
 							trans.from, len(trans.to)+len(trans.cc)+len(trans.bcc))
+						trans.discardData()
 					}
 					delete(tm.transactions, key)
 					delete(tm.timeouts, key)
@@ -105,7 +181,20 @@ func (tm *TransactionManager) startCleanupRoutine() {
 	}()
 }
 
+// launchDir is the working directory the process was started in, before
+// initWorkingDir moved it to the executable's directory.
+var launchDir string
+
+// resolveLaunchPath makes a user-supplied relative path relative to launchDir.
+func resolveLaunchPath(path string) string {
+	if path == "" || filepath.IsAbs(path) || launchDir == "" {
+		return path
+	}
+	return filepath.Join(launchDir, path)
+}
+
 func initWorkingDir() {
+	launchDir, _ = os.Getwd()
 	ex, err := os.Executable()
 	if err != nil {
 		fmt.Printf("Could not get executable path: %v", err)
@@ -121,25 +210,113 @@ func initWorkingDir() {
 }
 
 func loadConfig() error {
-	cfg, err := ini.Load("config.ini")
+	cfg, err := openConfigFile()
 	if err != nil {
 		return err
 	}
+	applyOverrides(cfg)
 
 	// Load Microsoft Graph settings
 	config.TenantID = cfg.Section("MicrosoftGraph").Key("TenantID").String()
 	config.ClientID = cfg.Section("MicrosoftGraph").Key("ClientID").String()
 	config.ClientSecret = cfg.Section("MicrosoftGraph").Key("ClientSecret").String()
-	config.Scope = cfg.Section("MicrosoftGraph").Key("Scope").String()
+	config.Scope = cfg.Section("MicrosoftGraph").Key("Scope").MustString("https://graph.microsoft.com/.default")
+
+	config.Tenants = loadTenantConfigs(cfg)
+	for _, t := range config.Tenants {
+		logger.Printf("Tenant %s serves domains: %s", t.Name, strings.Join(t.Domains, ", "))
+	}
+
+	// Load aliases
+	config.AliasesFile = cfg.Section("Aliases").Key("File").String()
+	if err := loadAliases(config.AliasesFile); err != nil {
+		return err
+	}
+
+	// Load the recipient policy
+	if config.RecipientPolicy, err = loadRecipientPolicy(cfg.Section("RecipientPolicy")); err != nil {
+		return err
+	}
+
+	// Load the attachment policy and the quarantine it may hold messages in
+	config.AttachmentPolicy = loadAttachmentPolicy(cfg.Section("AttachmentPolicy"))
+	config.QuarantineDirectory = cfg.Section("Quarantine").Key("Directory").MustString("quarantine")
+	config.QuarantineRetention = cfg.Section("Quarantine").Key("Retention").MustDuration(30 * 24 * time.Hour)
+
+	// Load the malware scanner settings
+	config.Scanner = loadScannerConfig(cfg.Section("Scanner"))
+
+	// Load the disclaimers
+	if config.Disclaimers, err = loadDisclaimers(cfg); err != nil {
+		return err
+	}
+
+	// Load address rewriting settings
+	config.RewriteMapFile = cfg.Section("Rewrite").Key("MapFile").String()
+	config.DefaultSender = cfg.Section("Rewrite").Key("DefaultSender").String()
+	if err := loadRewriteMaps(config.RewriteMapFile); err != nil {
+		return err
+	}
+
+	// Load sender validation settings
+	config.ValidateSenders = cfg.Section("SenderValidation").Key("Enabled").MustBool(false)
+	config.SenderPositiveTTL = cfg.Section("SenderValidation").Key("PositiveTTL").MustDuration(time.Hour)
+	config.SenderNegativeTTL = cfg.Section("SenderValidation").Key("NegativeTTL").MustDuration(10 * time.Minute)
 
 	// Load Server settings
-	config.Host = cfg.Section("Server").Key("Host").String()
-	config.Port = cfg.Section("Server").Key("SMTPPort").String()
+	config.Host = cfg.Section("Server").Key("Host").MustString("127.0.0.1")
+	config.Port = cfg.Section("Server").Key("SMTPPort").MustString("2525")
+	config.MaxMessageBytes = cfg.Section("Server").Key("MaxMessageBytes").MustInt64(35 * 1024 * 1024)
+	config.MaxRecipients = cfg.Section("Server").Key("MaxRecipients").MustInt(0)
+	config.ReadTimeout = cfg.Section("Server").Key("ReadTimeout").MustDuration(10 * time.Minute)
+	config.WriteTimeout = cfg.Section("Server").Key("WriteTimeout").MustDuration(5 * time.Minute)
+	config.MaxConnections = cfg.Section("Server").Key("MaxConnections").MustInt(100)
+	config.MaxConnectionsPerIP = cfg.Section("Server").Key("MaxConnectionsPerIP").MustInt(20)
+	config.TempDirectory = cfg.Section("Server").Key("TempDirectory").String()
+	config.MemoryBudget = cfg.Section("Server").Key("MemoryBudget").MustInt64(256 * 1024 * 1024)
+	messageMemory = newMemoryBudget(config.MemoryBudget)
 
 	// Load Service settings
 	config.ServiceName = cfg.Section("Service").Key("ServiceName").String()
 	// Parse Debug as a boolean (default is false if the value is missing)
 	config.Debug = cfg.Section("Service").Key("Debug").MustBool(false)
+	config.DryRun = cfg.Section("Service").Key("DryRun").MustBool(false)
+	config.DryRunDirectory = cfg.Section("Service").Key("DryRunDirectory").MustString("dryrun")
+
+	// Load Spool and sendmail settings
+	config.SpoolDirectory = cfg.Section("Spool").Key("Directory").MustString("spool")
+	config.SpoolPollInterval = cfg.Section("Spool").Key("PollInterval").MustDuration(30 * time.Second)
+	config.SpoolMaxAttempts = cfg.Section("Spool").Key("MaxAttempts").MustInt(10)
+	config.SendmailDelivery = strings.ToLower(cfg.Section("Sendmail").Key("Delivery").In("direct", []string{"direct", "spool"}))
+
+	// Load Delivery settings and build the transport
+	config.Delivery = loadTransportConfig(cfg)
+	config.Targets = loadTargetConfigs(cfg)
+	config.BreakerThreshold = cfg.Section("Delivery").Key("BreakerThreshold").MustInt(3)
+	config.BreakerCooldown = cfg.Section("Delivery").Key("BreakerCooldown").MustDuration(5 * time.Minute)
+	config.RecipientsPerMessage = cfg.Section("Delivery").Key("RecipientsPerMessage").MustInt(500)
+	config.Explode = cfg.Section("Delivery").Key("Explode").MustBool(false)
+	if activeTransport, err = buildDeliveryTransport(); err != nil {
+		return err
+	}
+	logger.Printf("Delivery transport: %s", activeTransport.Name())
+
+	// Load the mailbox delivery reports are sent from
+	config.Postmaster = cfg.Section("NDR").Key("Postmaster").String()
+
+	// Load the audit log location
+	config.AuditFile = cfg.Section("Audit").Key("File").String()
+
+	// Load the milter settings
+	config.Milters = cfg.Section("Milter").Key("Servers").Strings(",")
+	config.MilterDefaultAction = strings.ToLower(cfg.Section("Milter").Key("DefaultAction").In("accept", []string{"accept", "tempfail", "reject"}))
+	config.MilterTimeout = cfg.Section("Milter").Key("Timeout").MustDuration(30 * time.Second)
+
+	// Load the message rules, which may name tenants and targets
+	config.RulesFile = cfg.Section("Rules").Key("File").String()
+	if err := loadRules(config.RulesFile, cfg); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -169,56 +346,76 @@ func initLogger() error {
 // --- SMTP Backend ---
 type Backend struct{}
 
-func (bkd *Backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	var clientIP net.IP
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	sessionID := uuid.New().String()
+	milter, err := newMilterSession(sessionID, c.Hostname(), c.Conn().RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
 	return &Session{
-		sessionID: uuid.New().String(),
+		sessionID: sessionID,
+		clientIP:  clientIP,
+		milter:    milter,
 	}, nil
 }
 
 // EmailTransaction represents an ongoing email transaction.
 type EmailTransaction struct {
-	from        string   // Sender email
-	to          []string // Recipients (To, CC, BCC)
-	cc          []string
-	bcc         []string
-	dataBuffers []bytes.Buffer // Email message parts (for DATA)
+	from     string   // Sender email
+	to       []string // Recipients (To, CC, BCC)
+	cc       []string
+	bcc      []string
+	dataPath string // Raw message (DATA) in a temporary file; see stream.go
+	dataSize int64
+	clientIP net.IP // SMTP client, nil for locally submitted mail
+
+	returnPath string     // MAIL FROM, where delivery reports go; "" for the null sender
+	dsn        messageDSN // DSN parameters of MAIL FROM and RCPT TO; see dsn.go
+
+	scanned    bool   // Malware scan done; see scan.go
+	quarantine string // Reason to quarantine instead of delivering, if any
+	released   bool   // Released from the quarantine, so not held again
+
+	delivered []string // Recipients an earlier attempt reached; see chunk.go
+
+	authUser  string       // Local user that ran sendmail; the relay does not offer SMTP AUTH
+	sessionID string       // SMTP session, empty for locally submitted mail
+	rules     *ruleOutcome // Rules evaluated at the end of DATA; nil if not yet
+	discarded string       // Reason the message is accepted but dropped, if any
+	refused   []string     // Recipients refused at RCPT, kept out when read from headers
 }
 
+// addRecipient adds rcpt, or the members of the alias it names.
 func (e *EmailTransaction) addRecipient(rcpt string) {
-	for _, r := range e.to {
-		if strings.EqualFold(r, rcpt) {
-			return // Avoid duplicates
+	for _, addr := range expandAlias(rcpt) {
+		if !containsFold(e.to, addr) && !containsFold(e.refused, addr) { // Avoid duplicates
+			e.to = append(e.to, addr)
 		}
 	}
-	e.to = append(e.to, rcpt)
-}
-
-func (e *EmailTransaction) appendData(content []byte) {
-	var buffer bytes.Buffer
-	buffer.Write(content)
-	e.dataBuffers = append(e.dataBuffers, buffer)
-}
-
-func (e *EmailTransaction) resetDataBuffers() {
-	e.dataBuffers = make([]bytes.Buffer, 0) // Clear data buffers
 }
 
 func (e *EmailTransaction) resetAll() {
 	e.from = ""
 	e.to = nil
-	e.resetDataBuffers()
+	e.discardData()
 }
 
 // --- SMTP Session ---
 type Session struct {
 	mu          sync.Mutex
 	sessionID   string
+	clientIP    net.IP
 	currentKey  string
 	activeEmail string
 	pendingKeys []string // Add this to track all transactions in the session
+	milter      *milterSession
 }
 
-func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -226,7 +423,7 @@ func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
 	if s.currentKey != "" {
 		globalManager.mu.Lock()
 		if trans, exists := globalManager.transactions[s.currentKey]; exists {
-			if len(trans.dataBuffers) > 0 {
+			if trans.hasData() {
 				// Only save transactions that have received data
 				s.pendingKeys = append(s.pendingKeys, s.currentKey)
 				logger.Printf("[%s] Added transaction to pending: %s", s.sessionID, s.currentKey)
@@ -235,13 +432,37 @@ func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
 		globalManager.mu.Unlock()
 	}
 
+	// Checks apply to the sender as it will be rewritten for delivery
+	sender := canonicalSender(from)
+
+	// With tenants configured, only senders in a tenant's domains are relayed.
+	// The null sender, used by bounces, is checked once the header From is
+	// known at the end of DATA.
+	if len(config.Tenants) > 0 && sender != "" && tenantForSender(sender) == nil {
+		logger.Printf("[%s] Rejected MAIL FROM %s: no tenant serves this domain", s.sessionID, from)
+		return errNoTenant
+	}
+
+	if config.ValidateSenders && sender != "" {
+		if err := validateSender(sender); err != nil {
+			logger.Printf("[%s] Rejected MAIL FROM %s: %v", s.sessionID, from, err)
+			return err
+		}
+	}
+
+	if err := s.milter.mail(s.sessionID, from); err != nil {
+		logger.Printf("[%s] Rejected MAIL FROM %s: %v", s.sessionID, from, err)
+		return err
+	}
+
 	// Create new transaction
 	s.activeEmail = from
 	transactionTime := time.Now().UnixNano()
 	s.currentKey = fmt.Sprintf("%s:%s:%d", s.sessionID, from, transactionTime)
 
 	globalManager.mu.Lock()
-	trans := &EmailTransaction{from: from}
+	trans := &EmailTransaction{from: from, returnPath: from, clientIP: s.clientIP, sessionID: s.sessionID}
+	trans.dsn.setMail(opts)
 	globalManager.transactions[s.currentKey] = trans
 	globalManager.timeouts[s.currentKey] = time.Now()
 	globalManager.mu.Unlock()
@@ -250,7 +471,7 @@ func (s *Session) Mail(from string, _ *smtp.MailOptions) error {
 	return nil
 }
 
-func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -259,6 +480,19 @@ func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
 		return fmt.Errorf("no active transaction")
 	}
 
+	// Check the addresses the recipient will actually be delivered to
+	sender := canonicalSender(s.activeEmail)
+	for _, addr := range expandAlias(to) {
+		if err := checkRecipient(sender, s.clientIP, recipientRewrites.rewrite(addr)); err != nil {
+			logger.Printf("[%s] Rejected RCPT TO %s", s.sessionID, to)
+			return err
+		}
+	}
+	if err := s.milter.rcpt(to); err != nil {
+		logger.Printf("[%s] Rejected RCPT TO %s: %v", s.sessionID, to, err)
+		return err
+	}
+
 	globalManager.mu.Lock()
 	trans, exists := globalManager.transactions[s.currentKey]
 	if !exists {
@@ -266,10 +500,17 @@ func (s *Session) Rcpt(to string, _ *smtp.RcptOptions) error {
 		logger.Printf("[%s] Error: Transaction not found for key: %s", s.sessionID, s.currentKey)
 		return fmt.Errorf("transaction not found")
 	}
+	before := len(trans.to)
 	trans.addRecipient(to)
+	added := trans.to[before:]
+	trans.dsn.setRecipient(added, opts)
 	globalManager.timeouts[s.currentKey] = time.Now()
 	globalManager.mu.Unlock()
 
+	if len(added) == 0 && len(expandAlias(to)) == 0 {
+		logger.Printf("[%s] Rejected RCPT TO %s: alias has no deliverable members", s.sessionID, to)
+		return errEmptyAlias
+	}
 	logger.Printf("[%s] Recipient added: %s", s.sessionID, to)
 	return nil
 }
@@ -282,19 +523,62 @@ func (s *Session) Data(r io.Reader) error {
 		return fmt.Errorf("no active transaction")
 	}
 
-	var tempBuffer bytes.Buffer
-	if _, err := io.Copy(&tempBuffer, r); err != nil {
+	globalManager.mu.Lock()
+	trans, exists := globalManager.transactions[s.currentKey]
+	globalManager.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("transaction not found")
+	}
+
+	// The message goes straight to a temporary file; only its header is read
+	header, err := processEmailContent(r, trans)
+	if err != nil {
 		logger.Printf("Failed to read DATA content: %v", err)
+		trans.discardData()
 		return err
 	}
+	debugLog("[%s] Stored %d bytes of DATA in %s", s.sessionID, trans.dataSize, trans.dataPath)
+
+	// The message is sent as its header From, which need not be MAIL FROM,
+	// so the tenant check and sender validation apply to that address too
+	sender := canonicalSender(trans.from)
+	if len(config.Tenants) > 0 && tenantForSender(sender) == nil {
+		logger.Printf("[%s] Rejected message from %s: no tenant serves this domain", s.sessionID, sender)
+		auditRejected(trans, header, errNoTenant)
+		trans.discardData()
+		return errNoTenant
+	}
+	if config.ValidateSenders && sender != "" {
+		if err := validateSender(sender); err != nil {
+			logger.Printf("[%s] Rejected message from %s: %v", s.sessionID, sender, err)
+			auditRejected(trans, header, err)
+			trans.discardData()
+			return err
+		}
+	}
 
-	msg, err := message.Read(strings.NewReader(tempBuffer.String()))
-	if err != nil {
-		logger.Printf("Failed to parse email: %v", err)
+	if err := s.milter.data(trans); err != nil {
+		auditRejected(trans, header, err)
+		trans.discardData()
+		return err
+	}
+	if err := checkAttachmentsAtData(trans); err != nil {
+		auditRejected(trans, header, err)
+		trans.discardData()
+		return err
+	}
+	if err := scanTransaction(trans); err != nil {
+		auditRejected(trans, header, err)
+		trans.discardData()
+		return err
+	}
+	if err := applyRulesAtData(trans, header); err != nil {
+		auditRejected(trans, header, err)
+		trans.discardData()
 		return err
 	}
 
-	subject := msg.Header.Get("Subject")
+	subject := header.Get("Subject")
 	if subject == "" {
 		subject = "No Subject"
 	}
@@ -315,24 +599,26 @@ func (s *Session) Data(r io.Reader) error {
 	logger.Printf("[%s] Email transaction updated with subject: %s", s.sessionID, subject)
 	s.currentKey = finalKey
 
-	return processEmailContent(msg, tempBuffer.Bytes(), globalManager.transactions[finalKey])
+	return nil
 }
 
 func (s *Session) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	debugLog("[%s] RESET command received. Pending transactions: %d", s.sessionID, len(s.pendingKeys))
+	s.milter.abort()
 
 }
 
 func (s *Session) Logout() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.milter.close()
 
 	// If there's a current transaction with data, add it to pending
 	if s.currentKey != "" {
 		globalManager.mu.Lock()
-		if trans, exists := globalManager.transactions[s.currentKey]; exists && len(trans.dataBuffers) > 0 {
+		if trans, exists := globalManager.transactions[s.currentKey]; exists && trans.hasData() {
 			s.pendingKeys = append(s.pendingKeys, s.currentKey)
 			logger.Printf("[%s] Added final transaction to pending: %s", s.sessionID, s.currentKey)
 		}
@@ -344,20 +630,30 @@ func (s *Session) Logout() error {
 	logger.Printf("[%s] Processing %d pending transactions", s.sessionID, len(s.pendingKeys))
 
 	for _, key := range s.pendingKeys {
+		// The transaction leaves the manager before it is processed, so the
+		// cleanup routine cannot discard it and other sessions are not held
+		// up while it is delivered and reported
 		globalManager.mu.Lock()
 		trans, exists := globalManager.transactions[key]
-		if exists {
-			logger.Printf("[%s] Processing transaction: %s", s.sessionID, key)
-			if err := processEmail(trans); err != nil {
-				lastErr = err
-				logger.Printf("[%s] Failed to process email: %v", s.sessionID, err)
-			} else {
-				logger.Printf("[%s] Successfully processed transaction: %s", s.sessionID, key)
+		delete(globalManager.transactions, key)
+		delete(globalManager.timeouts, key)
+		globalManager.mu.Unlock()
+		if !exists {
+			continue
+		}
+
+		logger.Printf("[%s] Processing transaction: %s", s.sessionID, key)
+		if result, err := processEmail(trans); err != nil {
+			lastErr = err
+			logger.Printf("[%s] Failed to process email: %v", s.sessionID, err)
+			deferOrReport(trans, err)
+		} else {
+			logger.Printf("[%s] Successfully processed transaction: %s via %s (request-id %s, %v)", s.sessionID, key, result.Transport, result.RequestID, result.Duration)
+			if result.Transport != "quarantine" && result.Transport != "discard" {
+				sendSuccessDSN(trans.returnPath, trans.to, trans.dataPath, &trans.dsn)
 			}
-			delete(globalManager.transactions, key)
-			delete(globalManager.timeouts, key)
 		}
-		globalManager.mu.Unlock()
+		trans.discardData()
 	}
 
 	// Clean up the session state
@@ -373,8 +669,22 @@ func (s *Session) Logout() error {
 	return nil
 }
 
-func processEmailContent(msg *message.Entity, data []byte, trans *EmailTransaction) error {
-	header := mail.Header{Header: msg.Header}
+// processEmailContent stores the raw message read from r for trans and
+// takes the sender and To recipients from its header, which it returns.
+func processEmailContent(r io.Reader, trans *EmailTransaction) (mail.Header, error) {
+	if err := trans.storeData(r); err != nil {
+		return mail.Header{}, err
+	}
+	f, err := trans.openData()
+	if err != nil {
+		return mail.Header{}, err
+	}
+	defer f.Close()
+	h, err := textproto.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return mail.Header{}, fmt.Errorf("invalid message header: %w", err)
+	}
+	header := mail.Header{Header: message.Header{Header: h}}
 
 	if from, err := header.AddressList("From"); err == nil && len(from) > 0 {
 		trans.from = from[0].Address
@@ -386,33 +696,63 @@ func processEmailContent(msg *message.Entity, data []byte, trans *EmailTransacti
 		}
 	}
 
-	trans.appendData(data)
-	return nil
+	return header, nil
 }
 
 // --- Email Processing ---
-func processEmail(trans *EmailTransaction) error {
-	if trans.from == "" || len(trans.to) == 0 || len(trans.dataBuffers) == 0 {
+
+// DeliveryResult describes how a message was handed over by a transport.
+type DeliveryResult struct {
+	Transport string        // Name of the transport that delivered the message
+	RequestID string        // Graph request-id, or the transport's own message ID
+	Attempts  int           // Number of attempts, including retries
+	Duration  time.Duration // Time spent in the transport
+}
+
+func processEmail(trans *EmailTransaction) (result *DeliveryResult, err error) {
+	sender := canonicalSender(trans.from)
+	if sender == "" || len(trans.to) == 0 || !trans.hasData() {
 		logger.Println("Empty transaction. Skipping email processing.")
-		return fmt.Errorf("invalid email transaction: missing required fields")
+		return nil, fmt.Errorf("invalid email transaction: missing required fields")
 	}
 
-	// Concatenate all buffers into the email content
-	var fullBody bytes.Buffer
-	for _, buffer := range trans.dataBuffers {
-		fullBody.Write(buffer.Bytes())
-	}
-	emailContent := fullBody.String()
+	// Whatever happens to the message from here on goes to the audit log
+	start := time.Now()
+	audit := newAuditEntry(trans, sender)
+	defer func() { audit.finish(result, err, time.Since(start)) }()
 
-	logger.Printf("Processing email from: %s", trans.from)
+	if sender != trans.from {
+		logger.Printf("Rewrote sender %q -> %s", trans.from, sender)
+	}
+	logger.Printf("Processing email from: %s", sender)
 	logger.Printf("Recipients: %v", trans.to)
 
-	// Parse the email using go-message
-	r := strings.NewReader(emailContent)
-	msg, err := mail.CreateReader(r)
+	// Scan for malware, unless that was done at the end of DATA
+	if err := scanTransaction(trans); err != nil {
+		return nil, &DeliveryError{Err: err, Temporary: err == errScannerUnavailable}
+	}
+	if trans.quarantine != "" {
+		id, err := quarantineMessage(trans, sender, trans.quarantine)
+		if err != nil {
+			return nil, &DeliveryError{Err: err, Temporary: true}
+		}
+		return &DeliveryResult{Transport: "quarantine", RequestID: id}, nil
+	}
+	if trans.discarded != "" {
+		logger.Printf("Message from %s %s", sender, trans.discarded)
+		return &DeliveryResult{Transport: "discard"}, nil
+	}
+
+	// Parse the email using go-message, streaming from the stored DATA
+	data, err := trans.openData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message data: %w", err)
+	}
+	defer data.Close()
+	msg, err := mail.CreateReader(bufio.NewReader(data))
 	if err != nil {
 		logger.Printf("Failed to parse email: %v", err)
-		return fmt.Errorf("failed to parse email: %v", err)
+		return nil, fmt.Errorf("failed to parse email: %v", err)
 	}
 
 	// Extract Subject
@@ -421,29 +761,53 @@ func processEmail(trans *EmailTransaction) error {
 		subject = headerSubject
 	}
 	logger.Printf("Email subject: %s", subject)
+	audit.Subject = subject
+
+	// Apply the message rules, unless that was done at the end of DATA
+	rules := trans.rules
+	if rules == nil {
+		rules = evaluateRules(trans, msg.Header)
+	}
+	if rules.reject != "" {
+		return nil, &DeliveryError{Err: fmt.Errorf("rejected by rules: %s", rules.reject)}
+	}
+	if rules.discard {
+		logger.Printf("Message from %s discarded by rule %s", sender, rules.matched[len(rules.matched)-1])
+		return &DeliveryResult{Transport: "discard"}, nil
+	}
+	subject = prefixSubject(subject, rules.subjectPrefix)
 
 	// Extract To, CC, and classify BCC recipients
 	var (
 		toList      []string
 		ccList      []string
 		bccList     []string
-		attachments []map[string]interface{} // Array for attachments
-		rcptMap     = make(map[string]bool)  // Track recipients
+		attachments []Attachment
+		rcptMap     = make(map[string]bool) // Track recipients
 		textBody    string
 		htmlBody    string
 	)
 
-	// Parse To and CC headers
+	// Parse To and CC headers, expanding aliases so their members keep
+	// the field the alias was addressed in
 	if toAddrs, err := msg.Header.AddressList("To"); err == nil {
 		for _, addr := range toAddrs {
-			toList = append(toList, addr.Address)
-			rcptMap[strings.ToLower(addr.Address)] = true
+			for _, a := range expandAlias(addr.Address) {
+				if !rcptMap[strings.ToLower(a)] {
+					toList = append(toList, a)
+					rcptMap[strings.ToLower(a)] = true
+				}
+			}
 		}
 	}
 	if ccAddrs, err := msg.Header.AddressList("Cc"); err == nil {
 		for _, addr := range ccAddrs {
-			ccList = append(ccList, addr.Address)
-			rcptMap[strings.ToLower(addr.Address)] = true
+			for _, a := range expandAlias(addr.Address) {
+				if !rcptMap[strings.ToLower(a)] {
+					ccList = append(ccList, a)
+					rcptMap[strings.ToLower(a)] = true
+				}
+			}
 		}
 	}
 
@@ -454,22 +818,208 @@ func processEmail(trans *EmailTransaction) error {
 		}
 	}
 
-	// Process MIME parts to extract body and attachments
-	for {
+	// Process MIME parts to extract body and attachments. Every part is
+	// decoded into a file in workDir; the bodies are read back into memory
+	// once the memory budget allows it.
+	workDir, err := createTempDir("parts-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	parts, err := extractParts(msg, workDir)
+	if err != nil {
+		return nil, err
+	}
+	attachments = parts.attachments
+	audit.setAttachments(attachments)
+
+	// Apply the attachment policy: a rejection fails the message for good,
+	// a quarantined message is accepted but not delivered
+	var notices []string
+	if config.AttachmentPolicy.enabled() {
+		verdict := evaluateAttachments(attachments)
+		logAttachmentDecisions(verdict)
+		if verdict.reject != "" {
+			return nil, &DeliveryError{Err: fmt.Errorf("rejected by attachment policy: %s", verdict.reject)}
+		}
+		if verdict.quarantine != "" && trans.released {
+			logger.Printf("Delivering message released from quarantine: %s", verdict.quarantine)
+			verdict.keepQuarantined()
+		} else if verdict.quarantine != "" {
+			id, err := quarantineMessage(trans, sender, verdict.quarantine)
+			if err != nil {
+				return nil, &DeliveryError{Err: err, Temporary: true}
+			}
+			return &DeliveryResult{Transport: "quarantine", RequestID: id}, nil
+		}
+		attachments = verdict.kept
+		notices = verdict.notices
+	}
+
+	// The bodies are held as strings and once more while the request is
+	// encoded; inline images grow by a third as base64 data URIs.
+	needed := parts.textSize + parts.htmlSize
+	if parts.htmlPath != "" {
+		for _, img := range parts.images {
+			needed += img.size*4/3 + int64(len(img.contentType)) + 16
+		}
+	}
+	needed *= 2
+	if err := messageMemory.acquire(needed); err != nil {
+		return nil, err
+	}
+	defer messageMemory.release(needed)
+
+	if parts.textPath != "" {
+		b, err := os.ReadFile(parts.textPath)
+		if err != nil {
+			return nil, err
+		}
+		textBody = string(b)
+	}
+	if parts.htmlPath != "" {
+		b, err := os.ReadFile(parts.htmlPath)
+		if err != nil {
+			return nil, err
+		}
+		htmlBody = string(b)
+
+		// Replace the cid: references in HTML with the base64 data
+		for _, img := range parts.images {
+			b, err := os.ReadFile(img.path)
+			if err != nil {
+				return nil, err
+			}
+			oldRef := fmt.Sprintf("cid:%s", img.contentID)
+			newRef := fmt.Sprintf("data:%s;base64,%s", img.contentType, base64.StdEncoding.EncodeToString(b))
+			htmlBody = strings.ReplaceAll(htmlBody, oldRef, newRef)
+		}
+	}
+	textBody, htmlBody = addNotices(textBody, htmlBody, notices)
+
+	// Apply recipient rewriting before the lists reach the transport
+	toList = canonicalRecipients(toList)
+	ccList = canonicalRecipients(ccList)
+	bccList = canonicalRecipients(bccList)
+
+	// Recipients taken from the headers never passed RCPT, so the recipient
+	// policy is applied again here
+	toList = filterRecipients(sender, trans.clientIP, toList)
+	ccList = filterRecipients(sender, trans.clientIP, ccList)
+	bccList = filterRecipients(sender, trans.clientIP, bccList)
+	envelopeTo := filterRecipients(sender, trans.clientIP, canonicalRecipients(trans.to))
+	if len(trans.refused) > 0 {
+		toList, ccList = notIn(toList, trans.refused), notIn(ccList, trans.refused)
+		bccList, envelopeTo = notIn(bccList, trans.refused), notIn(envelopeTo, trans.refused)
+	}
+	if len(envelopeTo) == 0 {
+		return nil, fmt.Errorf("no recipients left after applying the recipient policy")
+	}
+
+	// Recipients from rules are set by the administrator and bypass the
+	// recipient policy
+	if rules.redirect != nil {
+		logger.Printf("Redirecting message from %s to %v", sender, rules.redirect)
+		envelopeTo, toList, ccList, bccList = rules.redirect, rules.redirect, nil, nil
+	}
+	for _, rcpt := range rules.addRecipients {
+		if !containsFold(envelopeTo, rcpt) {
+			envelopeTo = append(envelopeTo, rcpt)
+			bccList = append(bccList, rcpt)
+		}
+	}
+
+	// Add the disclaimer once the final recipients are known
+	textBody, htmlBody = applyDisclaimer(sender, subject, envelopeTo, textBody, htmlBody)
+
+	// Use HTML body if available; otherwise, fallback to plain-text
+	messageBody := textBody
+	bodyContentType := "Text"
+	if htmlBody != "" {
+		messageBody = htmlBody
+		bodyContentType = "HTML"
+	}
+
+	// Debug recipients and attachments
+	logger.Printf("Final Recipients: To: %v, Cc: %v, Bcc: %v", toList, ccList, bccList)
+	audit.To, audit.Cc, audit.Bcc = toList, ccList, bccList
+	for _, a := range attachments {
+		debugLog("Attachment: %s (%s, %d bytes)", a.Name, a.ContentType, a.Size)
+	}
+
+	//if messageBody == "" {
+	//	return fmt.Errorf("email has no body content")
+	//}
+
+	env := &Envelope{From: sender, To: envelopeTo}
+	outbound := &OutboundMessage{
+		Subject:         subject,
+		BodyContentType: bodyContentType,
+		Body:            messageBody,
+		To:              toList,
+		Cc:              ccList,
+		Bcc:             bccList,
+		Attachments:     attachments,
+		Header:          msg.Header,
+		Delivered:       trans.delivered,
+		SetHeaders:      rules.setHeaders,
+		Importance:      rules.importance,
+		Tenant:          rules.tenant,
+	}
+
+	transport := activeTransport
+	if rules.transport != nil {
+		transport = rules.transport
+	}
+	result, err = sendChunked(transport, env, outbound)
+	if err != nil {
+		logger.Printf("Failed to send email via %s: %v", transport.Name(), err)
+		audit.Transport = transport.Name()
+		return nil, fmt.Errorf("failed to send email: %w", err)
+	}
+	if result.Transport == "" {
+		result.Transport = transport.Name()
+	}
+
+	logger.Printf("Email processed and sent successfully via %s (id %s)", result.Transport, result.RequestID)
+	return result, nil
+}
+
+// inlineImage is an inline image part that may be referenced by cid: URLs
+// from the HTML body.
+type inlineImage struct {
+	contentID   string
+	contentType string
+	path        string
+	size        int64
+}
+
+// messageParts are the parts of a message, decoded into files.
+type messageParts struct {
+	textPath, htmlPath string // First text/plain and text/html parts
+	textSize, htmlSize int64
+	images             []inlineImage
+	attachments        []Attachment
+}
+
+// extractParts decodes every part of msg into a file in workDir.
+func extractParts(msg *mail.Reader, workDir string) (*messageParts, error) {
+	p := &messageParts{}
+	for n := 0; ; n++ {
 		part, err := msg.NextPart()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			logger.Printf("Failed to read MIME part: %v", err)
-			return fmt.Errorf("failed to read MIME part: %v", err)
+			return nil, fmt.Errorf("failed to read MIME part: %v", err)
 		}
 
 		// Handle Inline Headers for email content
 		switch h := part.Header.(type) {
 		case *mail.InlineHeader:
 			contentType, params, _ := h.ContentType()
-			bodyBytes, _ := io.ReadAll(part.Body)
 			charsetName := params["charset"]
 			charsetName = strings.ToLower(charsetName)
 
@@ -477,75 +1027,43 @@ func processEmail(trans *EmailTransaction) error {
 
 			switch contentType {
 			case "text/plain":
-				if textBody == "" { // Use first plain-text part
-					textBody = string(bodyBytes)
+				if p.textPath == "" { // Use first plain-text part
+					if p.textPath, p.textSize, err = savePart(workDir, n, part.Body); err != nil {
+						return nil, err
+					}
 				}
 			case "text/html":
-				if htmlBody == "" { // Use first HTML part, if present
-					htmlBody = string(bodyBytes)
+				if p.htmlPath == "" { // Use first HTML part, if present
+					if p.htmlPath, p.htmlSize, err = savePart(workDir, n, part.Body); err != nil {
+						return nil, err
+					}
 				}
 			case "image/png", "image/jpeg", "image/jpg", "image/bmp", "image/gif": // Handle inline images
-				contentID := h.Get("Content-ID")
-				contentID = strings.Trim(contentID, "<>")
-
-				// Convert the image to base64
-				base64Image := base64.StdEncoding.EncodeToString(bodyBytes)
-
-				// Replace the cid: reference in HTML with the base64 data
-				if htmlBody != "" {
-					oldRef := fmt.Sprintf("cid:%s", contentID)
-					newRef := fmt.Sprintf("data:%s;base64,%s", contentType, base64Image)
-					htmlBody = strings.ReplaceAll(htmlBody, oldRef, newRef)
+				img := inlineImage{contentID: strings.Trim(h.Get("Content-ID"), "<>"), contentType: contentType}
+				if img.path, img.size, err = savePart(workDir, n, part.Body); err != nil {
+					return nil, err
 				}
-
+				p.images = append(p.images, img)
 			}
 
 		case *mail.AttachmentHeader:
 			// Extract Attachment Information
 			filename, _ := h.Filename()
 			contentType, _, _ := h.ContentType()
-			attachmentBytes, _ := io.ReadAll(part.Body)
-
-			// Add to Graph API's attachment structure
-			attachments = append(attachments, map[string]interface{}{
-				"@odata.type":  "#microsoft.graph.fileAttachment",
-				"name":         filename,
-				"contentType":  contentType,
-				"contentBytes": base64.StdEncoding.EncodeToString(attachmentBytes),
+			path, size, err := savePart(workDir, n, part.Body)
+			if err != nil {
+				return nil, err
+			}
+
+			p.attachments = append(p.attachments, Attachment{
+				Name:        filename,
+				ContentType: contentType,
+				Size:        size,
+				path:        path,
 			})
 		}
 	}
-
-	// Use HTML body if available; otherwise, fallback to plain-text
-	messageBody := textBody
-	bodyContentType := "Text"
-	if htmlBody != "" {
-		messageBody = htmlBody
-		bodyContentType = "HTML"
-	}
-
-	// Debug recipients and attachments
-	logger.Printf("Final Recipients: To: %v, Cc: %v, Bcc: %v", toList, ccList, bccList)
-	debugLog("Attachments field (array): %v", attachments)
-
-	//if messageBody == "" {
-	//	return fmt.Errorf("email has no body content")
-	//}
-
-	// Ensure attachments is **always** an array (important fix)
-	if attachments == nil {
-		attachments = []map[string]interface{}{}
-	}
-
-	// Build the email payload
-	graphMessage := buildGraphMessage(subject, bodyContentType, messageBody, toList, ccList, bccList, attachments)
-	if err := sendMail(trans.from, graphMessage); err != nil {
-		logger.Printf("Failed to send email: %v", err)
-		return fmt.Errorf("failed to send email: %v", err)
-	}
-
-	logger.Println("Email processed and sent successfully")
-	return nil
+	return p, nil
 }
 
 func buildGraphMessage(subject string, bodyContentType string, messageBody string, toList []string, ccList []string, bccList []string, attachments []map[string]interface{}) map[string]interface{} {
@@ -581,9 +1099,23 @@ func buildRecipients(list []string) []map[string]interface{} {
 	return recipients
 }
 
-func sendMail(sender string, payload map[string]interface{}) error {
+// sendMail sends payload, a sendMail request body whose attachments array
+// is empty, with the given attachments streamed into it.
+func sendMail(creds GraphCredentials, sender string, payload map[string]interface{}, attachments []Attachment) (*DeliveryResult, error) {
+	if config.DryRun {
+		return writeDryRun(sender, payload, attachments)
+	}
+
+	// The request body is written once and re-read for every attempt.
+	bodyPath, err := writeRequestFile(payload, "attachments", attachments, graphAttachmentMeta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	defer os.Remove(bodyPath)
+
 	maxRetries := 3
 	var lastErr error
+	start := time.Now()
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
@@ -593,42 +1125,87 @@ func sendMail(sender string, payload map[string]interface{}) error {
 			time.Sleep(backoff)
 		}
 
-		if err := doSendMail(sender, payload); err != nil {
+		requestID, err := doSendMail(creds, sender, bodyPath, "application/json")
+		if err != nil {
 			lastErr = err
 			if !strings.Contains(err.Error(), "MailboxInfoStale") {
 				// If it's not a MailboxInfoStale error, return immediately
-				return err
+				return nil, err
 			}
 			continue
 		}
 
-		return nil // Success
+		// Success
+		return &DeliveryResult{RequestID: requestID, Attempts: attempt + 1, Duration: time.Since(start)}, nil
 	}
 
-	return fmt.Errorf("failed after %d retries. Last error: %v", maxRetries, lastErr)
+	return nil, fmt.Errorf("failed after %d retries. Last error: %w", maxRetries, lastErr)
 }
 
-func doSendMail(sender string, payload map[string]interface{}) error {
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s/sendMail", sender)
-	body, _ := json.Marshal(payload)
+// sendMIME sends msg rendered as MIME, which sendMail accepts base64-encoded
+// in a text/plain request body.
+func sendMIME(creds GraphCredentials, env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	if config.DryRun {
+		return writeDryRunMIME(env, msg)
+	}
 
-	token, err := getAccessToken()
+	f, err := createTempFile("request-*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	enc := base64.NewEncoder(base64.StdEncoding, f)
+	_, err = renderMessage(enc, env, msg)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get access token: %v", err)
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	start := time.Now()
+	requestID, err := doSendMail(creds, env.From, f.Name(), "text/plain")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return &DeliveryResult{RequestID: requestID, Attempts: 1, Duration: time.Since(start)}, nil
+}
+
+// doSendMail posts a single sendMail request with the body read from
+// bodyPath and returns the Graph request-id.
+func doSendMail(creds GraphCredentials, sender string, bodyPath string, contentType string) (string, error) {
+	url := sendMailURL(sender)
+	body, err := os.Open(bodyPath)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	token, err := getAccessToken(creds)
+	if err != nil {
+		// Token failures are specific to this app registration, so another
+		// target may still succeed.
+		return "", &DeliveryError{Err: fmt.Errorf("failed to get access token: %v", err), Temporary: true}
+	}
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return "", err
+	}
+	if info, err := body.Stat(); err == nil {
+		req.ContentLength = info.Size()
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer func() {
 		if cerr := resp.Body.Close(); cerr != nil {
@@ -636,32 +1213,47 @@ func doSendMail(sender string, payload map[string]interface{}) error {
 		}
 	}()
 
+	requestID := resp.Header.Get("request-id")
 	if resp.StatusCode != 202 {
 		responseBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("graph API error: %s", string(responseBody))
+		return requestID, &DeliveryError{
+			Err:        fmt.Errorf("graph API error (request-id %s): %s", requestID, string(responseBody)),
+			StatusCode: resp.StatusCode,
+			Temporary:  temporaryHTTPStatus(resp.StatusCode),
+		}
 	}
 
-	return nil
+	return requestID, nil
+}
+
+func sendMailURL(sender string) string {
+	return fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s/sendMail", url.PathEscape(sender))
+}
+
+// Get Microsoft Graph API access token, reusing a cached token for the same
+// app registration until shortly before it expires.
+func getAccessToken(creds GraphCredentials) (string, error) {
+	return tokenCacheFor(creds).get(creds)
 }
 
-// Get Microsoft Graph API access token.
-func getAccessToken() (string, error) {
-	url := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", config.TenantID)
+// requestAccessToken requests a new token and returns it with its lifetime.
+func requestAccessToken(creds GraphCredentials) (string, time.Duration, error) {
+	url := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", creds.TenantID)
 	data := fmt.Sprintf(
 		"client_id=%s&scope=%s&client_secret=%s&grant_type=client_credentials",
-		config.ClientID, config.Scope, config.ClientSecret,
+		creds.ClientID, creds.Scope, creds.ClientSecret,
 	)
 
 	req, err := http.NewRequest("POST", url, strings.NewReader(data))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer func() {
 		if cerr := resp.Body.Close(); cerr != nil {
@@ -670,17 +1262,86 @@ func getAccessToken() (string, error) {
 	}()
 
 	var result struct {
-		AccessToken string `json:"access_token"`
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
 	}
 	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("token request failed (%s): %s", resp.Status, strings.TrimSpace(result.Error+" "+result.ErrorDescription))
 	}
-	return result.AccessToken, nil
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
+
+// graphUser holds the mailbox properties we care about from GET /users/{id}.
+type graphUser struct {
+	ID                string `json:"id"`
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+}
+
+var errUserNotFound = errors.New("user not found")
+
+// lookupUser fetches a user from Microsoft Graph. It needs the User.Read.All
+// application permission in addition to Mail.Send.
+func lookupUser(token, address string) (*graphUser, error) {
+	endpoint := fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s?$select=id,displayName,mail,userPrincipalName", url.PathEscape(address))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			logger.Printf("Error closing response body: %v", cerr)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errUserNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("graph API error (%s): %s", resp.Status, string(responseBody))
+	}
+
+	var user graphUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
 // --- Main Function ---
 func main() {
 
+	// Parse global flags before changing directory so relative paths work.
+	// When installed as a sendmail symlink, all arguments belong to sendmail
+	// and only RELAY_CONFIG can choose the config file.
+	var args []string
+	if filepath.Base(os.Args[0]) == "sendmail" {
+		if err := resolveConfigPath(""); err != nil {
+			fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		args = append([]string{"sendmail"}, os.Args[1:]...)
+	} else {
+		var err error
+		if args, err = parseFlags(os.Args[1:]); err != nil {
+			os.Exit(2)
+		}
+	}
+
 	// Set the working directory to the executable's directory.
 	initWorkingDir()
 
@@ -694,53 +1355,101 @@ func main() {
 	if err := loadConfig(); err != nil {
 		logger.Fatalf("Error loading config: %v", err)
 	}
+	if config.Debug {
+		logger.Println("Debug mode enabled")
+	}
+	if config.DryRun {
+		logger.Printf("Dry-run mode enabled: Graph requests are written to %s instead of being sent", config.DryRunDirectory)
+	}
 
 	isWindowsService := isWindowsService()
 
 	// Determine if running as a Windows service
 	if !isWindowsService {
+		// sendmail mode does not echo the log to the calling script's stdout.
+		if len(args) > 0 && args[0] == "sendmail" {
+			os.Exit(runSendmail(args[1:]))
+		}
+
 		newWriter := io.MultiWriter(logger.Writer(), os.Stdout)
 		logger.SetOutput(newWriter)
 
 		// Check if there are additional command-line arguments
-		if len(os.Args) > 1 {
-			switch os.Args[1] {
+		if len(args) > 0 {
+			switch args[0] {
 			case "install":
-				if len(os.Args) < 5 { // Ensure arguments for service setup are provided
+				if len(args) < 4 { // Ensure arguments for service setup are provided
 					fmt.Println("Usage: install <service_name> <display_name> <description>")
 					os.Exit(1)
 				}
-				serviceName := os.Args[2]
-				displayName := os.Args[3]
-				description := os.Args[4]
+				serviceName := args[1]
+				displayName := args[2]
+				description := args[3]
 				installService(serviceName, displayName, description)
 				return
 
 			case "remove":
-				if len(os.Args) < 3 { // Ensure the service name is provided
+				if len(args) < 2 { // Ensure the service name is provided
 					fmt.Println("Usage: remove <service_name>")
 					os.Exit(1)
 				}
-				serviceName := os.Args[2]
+				serviceName := args[1]
 				removeService(serviceName)
 				return
 
+			case "check-config":
+				if !checkConfig(args[1:]) {
+					os.Exit(1)
+				}
+				return
+
+			case "send-test":
+				if err := sendTest(args[1:]); err != nil {
+					fmt.Printf("send-test failed: %v\n", err)
+					os.Exit(1)
+				}
+				return
+
+			case "queue":
+				if err := runQueue(args[1:]); err != nil {
+					fmt.Printf("queue: %v\n", err)
+					os.Exit(1)
+				}
+				return
+
+			case "quarantine":
+				if err := runQuarantine(args[1:]); err != nil {
+					fmt.Printf("quarantine: %v\n", err)
+					os.Exit(1)
+				}
+				return
+
+			case "verify-audit":
+				if err := verifyAudit(args[1:]); err != nil {
+					fmt.Printf("verify-audit: %v\n", err)
+					os.Exit(1)
+				}
+				return
+
 			case "help":
-				fmt.Println("Usage:")
+				fmt.Println("Usage: [flags] [command]")
+				fmt.Println("Commands:")
 				fmt.Println("  install <service_name> <display_name> <description> - Install the service.")
 				fmt.Println("  remove <service_name> - Remove the service.")
-				fmt.Println("  -debug - Enable debug mode (overrides config).")
+				fmt.Println("  check-config [sender ...] - Validate the configuration and Graph permissions.")
+				fmt.Println("  sendmail [-t] [-i] [-f <sender>] [recipient ...] - Read a message from stdin like /usr/sbin/sendmail.")
+				fmt.Println("  queue list|show <id>|retry <id>|all|delete <id>|hold <id>|release <id> - Manage spooled messages.")
+				fmt.Println("  quarantine list|show <id>|release <id>|delete <id> - Manage quarantined messages.")
+				fmt.Println("  verify-audit [file] - Check the hash chain of the audit log.")
+				fmt.Println("  send-test --from <addr> --to <addr>[,<addr>] [--subject <text>] [--attach <file>] [--via-smtp <host:port>] - Send a test message.")
 				fmt.Println("  <no arguments> - Run the application in service or standalone mode.")
+				fmt.Println("Flags (override config.ini and environment variables):")
+				flagSet.SetOutput(os.Stdout)
+				flagSet.PrintDefaults()
 				os.Exit(0)
 
-			case "-debug":
-				// Enable debug mode by overriding the config variable
-				config.Debug = true
-				logger.Println("Debug mode enabled")
-				// Continue to the application startup
-
 			default:
-				logger.Printf("Unknown command: %s\n", os.Args[1])
+				logger.Printf("Unknown command: %s\n", args[0])
 				logger.Println("Use 'help' for a list of available commands.")
 				os.Exit(1)
 			}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Milter Client ---
+//
+// [Milter] Servers lists content filters speaking the sendmail milter
+// protocol (version 6), such as OpenDKIM or rspamd:
+//
+//	[Milter]
+//	Servers = inet:127.0.0.1:8891, unix:/run/rspamd/milter.sock
+//	DefaultAction = accept
+//	Timeout = 30s
+//
+// Each SMTP session opens a connection to every milter and reports the
+// client, HELO, MAIL FROM and RCPT TO as they happen, then the headers and
+// body at the end of DATA. Milters are consulted in order and see the
+// changes made by the ones before them. Replies map to SMTP: reject (550)
+// and tempfail (451) refuse the command, discard accepts the message and
+// drops it, quarantine holds it in [Quarantine] Directory, and accept stops
+// that milter from seeing the rest of the message. Header, body, sender and
+// recipient changes are applied to the stored message before processEmail
+// sees it. DefaultAction (accept, tempfail or reject) applies when a milter
+// cannot be reached or fails mid-conversation.
+//
+// Mail submitted through sendmail or the spool has no SMTP session and is
+// not passed to milters.
+
+// Milter commands sent by the MTA.
+const (
+	milterAbort   = 'A'
+	milterBody    = 'B'
+	milterConnect = 'C'
+	milterMacro   = 'D'
+	milterEOB     = 'E'
+	milterHelo    = 'H'
+	milterHeader  = 'L'
+	milterMail    = 'M'
+	milterEOH     = 'N'
+	milterOptNeg  = 'O'
+	milterQuit    = 'Q'
+	milterRcpt    = 'R'
+)
+
+// Milter replies.
+const (
+	milterAddRcpt     = '+'
+	milterDelRcpt     = '-'
+	milterAddRcptPar  = '2'
+	milterAccept      = 'a'
+	milterReplBody    = 'b'
+	milterContinue    = 'c'
+	milterDiscard     = 'd'
+	milterChgFrom     = 'e'
+	milterAddHeader   = 'h'
+	milterInsHeader   = 'i'
+	milterChgHeader   = 'm'
+	milterProgress    = 'p'
+	milterQuarantine  = 'q'
+	milterReject      = 'r'
+	milterSkip        = 's'
+	milterTempfail    = 't'
+	milterReplyCode   = 'y'
+	milterVersion     = 6
+	milterChunkSize   = 65535
+	milterAllActions  = 0xff             // Every modification except SETSYMLIST
+	milterAllProtocol = 0xfffff &^ 0x800 // Every step may be skipped; no RCPT_REJ
+)
+
+// Protocol flags: steps a milter does not want, or does not reply to.
+const (
+	milterNoConnect = 1 << iota
+	milterNoHelo
+	milterNoMail
+	milterNoRcpt
+	milterNoBody
+	milterNoHeaders
+	milterNoEOH
+	milterNoReplyHeader
+	_ // NOUNKNOWN
+	_ // NODATA
+	milterCanSkip
+	_ // RCPT_REJ
+	milterNoReplyConnect
+	milterNoReplyHelo
+	milterNoReplyMail
+	milterNoReplyRcpt
+	_ // NR_DATA
+	_ // NR_UNKN
+	milterNoReplyEOH
+	milterNoReplyBody
+)
+
+// milterClient is the connection to one milter for an SMTP session.
+type milterClient struct {
+	address  string
+	conn     net.Conn
+	r        *bufio.Reader
+	protocol uint32
+	accepted bool // Accepted the current message; skip it until the next
+	broken   bool // Failed; DefaultAction was applied
+}
+
+// milterSession holds the milters of an SMTP session.
+type milterSession struct {
+	sessionID string
+	clients   []*milterClient
+	inMessage bool
+	discard   bool     // A milter discarded the message before DATA
+	rejected  []string // Recipients a milter rejected at RCPT
+}
+
+var (
+	errMilterReject = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Command rejected by content filter",
+	}
+	errMilterTempfail = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Content filter unavailable, try again later",
+	}
+)
+
+// newMilterSession connects to the milters and reports the client and its
+// HELO name. It returns nil when no milters are configured.
+func newMilterSession(sessionID, helo string, client net.Addr) (*milterSession, error) {
+	if len(config.Milters) == 0 {
+		return nil, nil
+	}
+	m := &milterSession{sessionID: sessionID}
+	for _, address := range config.Milters {
+		c, err := dialMilter(address)
+		if err != nil {
+			if err := m.failed(&milterClient{address: address, broken: true}, err); err != nil {
+				m.close()
+				return nil, err
+			}
+			continue
+		}
+		m.clients = append(m.clients, c)
+	}
+
+	host, port, family := "localhost", uint16(0), byte('U')
+	if addr, ok := client.(*net.TCPAddr); ok {
+		host, port, family = addr.IP.String(), uint16(addr.Port), '4'
+		if addr.IP.To4() == nil {
+			family = '6'
+		}
+	}
+	connect := append([]byte(host+"\x00"), family)
+	if family != 'U' {
+		connect = binary.BigEndian.AppendUint16(connect, port)
+		connect = append(connect, host+"\x00"...)
+	}
+
+	if err := m.step(func(c *milterClient) ([]byte, error) {
+		hostname, _ := os.Hostname()
+		c.macros(milterConnect, "j", hostname, "{daemon_name}", "RelayToGraph", "{client_addr}", host)
+		return c.command(milterConnect, connect, milterNoConnect, milterNoReplyConnect)
+	}); err != nil {
+		m.close()
+		return nil, err
+	}
+	if err := m.step(func(c *milterClient) ([]byte, error) {
+		return c.command(milterHelo, []byte(helo+"\x00"), milterNoHelo, milterNoReplyHelo)
+	}); err != nil {
+		m.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// dialMilter connects to inet:host:port, host:port, unix:/path or /path
+// and negotiates the protocol.
+func dialMilter(address string) (*milterClient, error) {
+	network, addr := "tcp", strings.TrimPrefix(address, "inet:")
+	if strings.HasPrefix(address, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(address, "unix:")
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, addr, config.MilterTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &milterClient{address: address, conn: conn, r: bufio.NewReader(conn)}
+
+	var neg []byte
+	neg = binary.BigEndian.AppendUint32(neg, milterVersion)
+	neg = binary.BigEndian.AppendUint32(neg, milterAllActions)
+	neg = binary.BigEndian.AppendUint32(neg, milterAllProtocol)
+	if err := c.send(milterOptNeg, neg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd, data, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cmd != milterOptNeg || len(data) < 12 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply %q to option negotiation", cmd)
+	}
+	c.protocol = binary.BigEndian.Uint32(data[8:12]) & milterAllProtocol
+	debugLog("Milter %s: version %d, actions %#x, protocol %#x", address,
+		binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8]), c.protocol)
+	return c, nil
+}
+
+func (c *milterClient) send(cmd byte, data []byte) error {
+	_ = c.conn.SetDeadline(time.Now().Add(config.MilterTimeout))
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(data)+1))
+	packet = append(packet, cmd)
+	_, err := c.conn.Write(append(packet, data...))
+	return err
+}
+
+// read returns the next reply, skipping progress notifications.
+func (c *milterClient) read() (byte, []byte, error) {
+	for {
+		_ = c.conn.SetDeadline(time.Now().Add(config.MilterTimeout))
+		var size [4]byte
+		if _, err := io.ReadFull(c.r, size[:]); err != nil {
+			return 0, nil, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 || n > 64*1024*1024 {
+			return 0, nil, fmt.Errorf("invalid packet length %d", n)
+		}
+		packet := make([]byte, n)
+		if _, err := io.ReadFull(c.r, packet); err != nil {
+			return 0, nil, err
+		}
+		if packet[0] != milterProgress {
+			return packet[0], packet[1:], nil
+		}
+	}
+}
+
+// macros sends macro definitions for the following command.
+func (c *milterClient) macros(cmd byte, pairs ...string) {
+	data := []byte{cmd}
+	for _, p := range pairs {
+		data = append(data, p+"\x00"...)
+	}
+	_ = c.send(milterMacro, data)
+}
+
+// command sends a command unless the milter opted out of it with skipFlag,
+// and reads the reply unless it opted out of that with noReplyFlag. A
+// skipped command or reply counts as continue.
+func (c *milterClient) command(cmd byte, data []byte, skipFlag, noReplyFlag uint32) ([]byte, error) {
+	if c.protocol&skipFlag != 0 {
+		return []byte{milterContinue}, nil
+	}
+	if err := c.send(cmd, data); err != nil {
+		return nil, err
+	}
+	if c.protocol&noReplyFlag != 0 {
+		return []byte{milterContinue}, nil
+	}
+	reply, data, err := c.read()
+	return append([]byte{reply}, data...), err
+}
+
+// step runs fn for every milter still interested in the message and turns
+// the first decisive reply into the SMTP error to return. fn returns the
+// reply code followed by its data.
+func (m *milterSession) step(fn func(c *milterClient) ([]byte, error)) error {
+	for _, c := range m.clients {
+		if c.broken || c.accepted {
+			continue
+		}
+		reply, err := fn(c)
+		if err != nil {
+			if err := m.failed(c, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.decide(c, reply[0], reply[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decide handles a reply that ends a step.
+func (m *milterSession) decide(c *milterClient, reply byte, data []byte) error {
+	switch reply {
+	case milterContinue:
+		return nil
+	case milterAccept:
+		debugLog("[%s] Milter %s accepted the message", m.sessionID, c.address)
+		c.accepted = true
+		return nil
+	case milterDiscard:
+		logger.Printf("[%s] Milter %s discarded the message", m.sessionID, c.address)
+		m.discard = true
+		return nil
+	case milterReject:
+		logger.Printf("[%s] Milter %s rejected the command", m.sessionID, c.address)
+		return errMilterReject
+	case milterTempfail:
+		logger.Printf("[%s] Milter %s returned tempfail", m.sessionID, c.address)
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Temporary failure in content filter"}
+	case milterReplyCode:
+		err := parseMilterReplyCode(string(bytes.TrimRight(data, "\x00")))
+		logger.Printf("[%s] Milter %s replied %v", m.sessionID, c.address, err)
+		return err
+	}
+	return m.failed(c, fmt.Errorf("unexpected reply %q", reply))
+}
+
+// parseMilterReplyCode turns "550 5.7.1 text" into an SMTP error.
+func parseMilterReplyCode(s string) error {
+	code, rest, _ := strings.Cut(s, " ")
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 400 || n > 599 {
+		return errMilterReject
+	}
+	e := &smtp.SMTPError{Code: n, EnhancedCode: smtp.EnhancedCode{n / 100, 0, 0}, Message: rest}
+	if enh, text, ok := strings.Cut(rest, " "); ok || enh != "" {
+		parts := strings.Split(enh, ".")
+		if len(parts) == 3 {
+			var ec smtp.EnhancedCode
+			valid := true
+			for i, p := range parts {
+				if ec[i], err = strconv.Atoi(p); err != nil {
+					valid = false
+				}
+			}
+			if valid {
+				e.EnhancedCode, e.Message = ec, text
+			}
+		}
+	}
+	return e
+}
+
+// failed applies DefaultAction to a milter that could not be reached or
+// broke the protocol.
+func (m *milterSession) failed(c *milterClient, err error) error {
+	c.broken = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	switch config.MilterDefaultAction {
+	case "tempfail":
+		logger.Printf("[%s] Milter %s failed: %v; deferring", m.sessionID, c.address, err)
+		return errMilterTempfail
+	case actionReject:
+		logger.Printf("[%s] Milter %s failed: %v; rejecting", m.sessionID, c.address, err)
+		return errMilterReject
+	}
+	logger.Printf("[%s] Milter %s failed: %v; continuing without it", m.sessionID, c.address, err)
+	return nil
+}
+
+// mail reports MAIL FROM and starts a new message.
+func (m *milterSession) mail(sessionID, from string) error {
+	if m == nil {
+		return nil
+	}
+	m.abort()
+	m.inMessage, m.discard, m.rejected = true, false, nil
+	for _, c := range m.clients {
+		c.accepted = false
+	}
+	return m.step(func(c *milterClient) ([]byte, error) {
+		c.macros(milterMail, "i", sessionID, "{mail_addr}", from)
+		return c.command(milterMail, []byte("<"+from+">\x00"), milterNoMail, milterNoReplyMail)
+	})
+}
+
+// rcpt reports RCPT TO.
+func (m *milterSession) rcpt(to string) error {
+	if m == nil {
+		return nil
+	}
+	err := m.step(func(c *milterClient) ([]byte, error) {
+		c.macros(milterRcpt, "{rcpt_addr}", to)
+		return c.command(milterRcpt, []byte("<"+to+">\x00"), milterNoRcpt, milterNoReplyRcpt)
+	})
+	if err != nil {
+		m.rejected = append(m.rejected, to)
+	}
+	return err
+}
+
+// abort tells the milters the current message is abandoned.
+func (m *milterSession) abort() {
+	if m == nil || !m.inMessage {
+		return
+	}
+	for _, c := range m.clients {
+		if !c.broken {
+			_ = c.send(milterAbort, nil)
+		}
+	}
+	m.inMessage = false
+}
+
+// close ends the milter conversations.
+func (m *milterSession) close() {
+	if m == nil {
+		return
+	}
+	for _, c := range m.clients {
+		if !c.broken {
+			_ = c.send(milterQuit, nil)
+			c.conn.Close()
+		}
+	}
+	m.clients = nil
+}
+
+// headerField is a header field of the stored message.
+type headerField struct {
+	name, value string // value without the leading space, folds as \r\n
+}
+
+// milterChanges are the modifications requested at end of body.
+type milterChanges struct {
+	headers      []headerField
+	headersDirty bool
+	body         []byte
+	replaceBody  bool
+}
+
+// data passes the stored message of trans through every milter, applying
+// the changes each one asks for before the next sees the message.
+func (m *milterSession) data(trans *EmailTransaction) error {
+	if m == nil {
+		return nil
+	}
+	defer func() { m.inMessage = false }()
+
+	// Header addresses are added to the recipients after DATA; keep out
+	// the ones a milter refused
+	trans.refused = append(trans.refused, m.rejected...)
+	trans.to = notIn(trans.to, trans.refused)
+
+	for _, c := range m.clients {
+		if c.broken || c.accepted {
+			continue
+		}
+		if err := m.filterMessage(c, trans); err != nil {
+			return err
+		}
+	}
+	if m.discard {
+		trans.discarded = "discarded by content filter"
+	}
+	return nil
+}
+
+// filterMessage sends the message to one milter and applies its changes.
+func (m *milterSession) filterMessage(c *milterClient, trans *EmailTransaction) error {
+	f, err := trans.openData()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	headers, err := readMilterHeaders(r)
+	if err != nil {
+		return m.failed(c, err)
+	}
+
+	reply, err := m.sendMessage(c, headers, r)
+	if err != nil {
+		return m.failed(c, err)
+	}
+	if reply != nil {
+		return m.decide(c, reply[0], reply[1:])
+	}
+
+	// End of body: read modifications until the final reply
+	changes := &milterChanges{headers: headers}
+	for {
+		cmd, data, err := c.read()
+		if err != nil {
+			return m.failed(c, err)
+		}
+		switch cmd {
+		case milterAddHeader, milterInsHeader, milterChgHeader:
+			changes.header(cmd, data)
+		case milterReplBody:
+			changes.body = append(changes.body, data...)
+			changes.replaceBody = true
+		case milterAddRcpt, milterAddRcptPar:
+			rcpt := strings.Trim(cString(data), "<>")
+			logger.Printf("[%s] Milter %s added recipient %s", m.sessionID, c.address, rcpt)
+			trans.addRecipient(rcpt)
+		case milterDelRcpt:
+			rcpt := strings.Trim(cString(data), "<>")
+			logger.Printf("[%s] Milter %s removed recipient %s", m.sessionID, c.address, rcpt)
+			var kept []string
+			for _, to := range trans.to {
+				if !strings.EqualFold(to, rcpt) {
+					kept = append(kept, to)
+				}
+			}
+			trans.to = kept
+		case milterChgFrom:
+			changeSender(trans, data)
+			logger.Printf("[%s] Milter %s changed the sender to %s", m.sessionID, c.address, trans.returnPath)
+		case milterQuarantine:
+			trans.quarantine = "content filter " + c.address + ": " + cString(data)
+		default:
+			if err := changes.apply(trans); err != nil {
+				return err
+			}
+			if changes.headersDirty || changes.replaceBody {
+				logger.Printf("[%s] Milter %s modified the message", m.sessionID, c.address)
+			}
+			return m.decide(c, cmd, data)
+		}
+	}
+}
+
+// changeSender applies a change sender request: the new MAIL FROM address,
+// optionally followed by its ESMTP parameters. The parameters, when given,
+// replace the DSN parameters of MAIL FROM.
+func changeSender(trans *EmailTransaction, data []byte) {
+	fields := strings.Split(string(data), "\x00")
+	trans.from = strings.Trim(fields[0], "<>")
+	trans.returnPath = trans.from
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		return
+	}
+	trans.dsn.EnvelopeID, trans.dsn.Return = "", ""
+	for _, param := range strings.Fields(fields[1]) {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "ENVID":
+			trans.dsn.EnvelopeID = decodeXtext(value)
+		case "RET":
+			trans.dsn.Return = strings.ToUpper(value)
+		}
+	}
+}
+
+// decodeXtext decodes an RFC 3461 xtext, in which "+" and two hex digits
+// stand for a byte. Invalid escapes are kept as written.
+func decodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sendMessage sends the headers and body. It returns the reply that ended
+// the conversation early, or nil once end of body has been sent.
+func (m *milterSession) sendMessage(c *milterClient, headers []headerField, body io.Reader) ([]byte, error) {
+	decisive := func(reply []byte) bool { return reply[0] != milterContinue }
+	for _, h := range headers {
+		value := strings.ReplaceAll(h.value, "\r\n", "\n")
+		reply, err := c.command(milterHeader, []byte(h.name+"\x00"+value+"\x00"), milterNoHeaders, milterNoReplyHeader)
+		if err != nil || decisive(reply) {
+			return reply, err
+		}
+	}
+	reply, err := c.command(milterEOH, nil, milterNoEOH, milterNoReplyEOH)
+	if err != nil || decisive(reply) {
+		return reply, err
+	}
+
+	if c.protocol&milterNoBody == 0 {
+		buf := make([]byte, milterChunkSize)
+		for {
+			n, rerr := io.ReadFull(body, buf)
+			if n > 0 {
+				reply, err := c.command(milterBody, buf[:n], 0, milterNoReplyBody)
+				if err != nil {
+					return nil, err
+				}
+				if reply[0] == milterSkip {
+					break
+				}
+				if decisive(reply) {
+					return reply, nil
+				}
+			}
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				break
+			}
+			if rerr != nil {
+				return nil, rerr
+			}
+		}
+	}
+	return nil, c.send(milterEOB, nil)
+}
+
+// header applies an add, insert or change header request.
+func (ch *milterChanges) header(cmd byte, data []byte) {
+	var index int
+	if cmd != milterAddHeader && len(data) >= 4 {
+		index = int(binary.BigEndian.Uint32(data[:4]))
+		data = data[4:]
+	}
+	fields := bytes.SplitN(data, []byte{0}, 3)
+	if len(fields) < 2 {
+		return
+	}
+	h := headerField{name: string(fields[0]), value: strings.ReplaceAll(string(fields[1]), "\n", "\r\n")}
+	h.value = strings.ReplaceAll(h.value, "\r\r\n", "\r\n")
+	ch.headersDirty = true
+
+	switch cmd {
+	case milterAddHeader:
+		ch.headers = append(ch.headers, h)
+	case milterInsHeader:
+		if index > len(ch.headers) {
+			index = len(ch.headers)
+		}
+		ch.headers = append(ch.headers[:index], append([]headerField{h}, ch.headers[index:]...)...)
+	case milterChgHeader:
+		// index counts occurrences of the name from 1; an empty value
+		// deletes the header, and a missing one is added.
+		seen := 0
+		for i, existing := range ch.headers {
+			if strings.EqualFold(existing.name, h.name) {
+				if seen++; seen == index {
+					if h.value == "" {
+						ch.headers = append(ch.headers[:i], ch.headers[i+1:]...)
+					} else {
+						ch.headers[i].value = h.value
+					}
+					return
+				}
+			}
+		}
+		if h.value != "" {
+			ch.headers = append(ch.headers, h)
+		}
+	}
+}
+
+// apply rewrites the stored message with the changed headers and body.
+func (ch *milterChanges) apply(trans *EmailTransaction) error {
+	if !ch.headersDirty && !ch.replaceBody {
+		return nil
+	}
+	src, err := trans.openData()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r := bufio.NewReader(src)
+	if _, err := readMilterHeaders(r); err != nil {
+		return err
+	}
+
+	f, err := createTempFile("data-*.eml")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, h := range ch.headers {
+		fmt.Fprintf(w, "%s: %s\r\n", h.name, h.value)
+	}
+	w.WriteString("\r\n")
+	if ch.replaceBody {
+		_, err = w.Write(ch.body)
+	} else {
+		_, err = io.Copy(w, r)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	trans.discardData()
+	trans.dataPath, trans.dataSize = f.Name(), info.Size()
+	return nil
+}
+
+// readMilterHeaders reads the header section, leaving r at the body.
+func readMilterHeaders(r *bufio.Reader) ([]headerField, error) {
+	var headers []headerField
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			return headers, nil // End of header, or of a message without body
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].value += "\r\n" + trimmed
+		} else if name, value, ok := strings.Cut(trimmed, ":"); ok {
+			headers = append(headers, headerField{name: name, value: strings.TrimPrefix(value, " ")})
+		}
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
+
+// cString returns data up to its first NUL.
+func cString(data []byte) string {
+	s, _, _ := strings.Cut(string(data), "\x00")
+	return s
+}
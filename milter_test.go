@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/emersion/go-smtp"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// milterPacket frames cmd and data as on the wire.
+func milterPacket(cmd byte, data string) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(data)+1))
+	return append(append(packet, cmd), data...)
+}
+
+// pipeMilterClient returns a client connected to the returned server end.
+func pipeMilterClient(t *testing.T) (*milterClient, net.Conn) {
+	t.Helper()
+	config.MilterTimeout = time.Second
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &milterClient{address: "test", conn: client, r: bufio.NewReader(client)}, server
+}
+
+func TestMilterSend(t *testing.T) {
+	c, server := pipeMilterClient(t)
+	go func() {
+		c.send(milterEOH, nil)
+		c.send(milterHeader, []byte("Subject\x00hi\x00"))
+	}()
+
+	want := []byte("\x00\x00\x00\x01N\x00\x00\x00\x0cLSubject\x00hi\x00")
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("send wrote %q, want %q", got, want)
+	}
+}
+
+func TestMilterRead(t *testing.T) {
+	tests := []struct {
+		name     string
+		wire     []byte
+		wantCmd  byte
+		wantData string
+		wantErr  string
+	}{
+		{"continue", milterPacket(milterContinue, ""), milterContinue, "", ""},
+		{"with data", milterPacket(milterReplyCode, "550 5.7.1 no\x00"), milterReplyCode, "550 5.7.1 no\x00", ""},
+		{"progress skipped", append(milterPacket(milterProgress, ""), milterPacket(milterAccept, "")...), milterAccept, "", ""},
+		{"zero length", []byte{0, 0, 0, 0}, 0, "", "invalid packet length 0"},
+		{"too long", []byte{0x10, 0, 0, 0, 'c'}, 0, "", "invalid packet length"},
+		{"truncated", milterPacket(milterReplyCode, "550")[:6], 0, "", "unexpected EOF"},
+		{"empty", nil, 0, "", "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := pipeMilterClient(t)
+			c.r = bufio.NewReader(bytes.NewReader(tt.wire))
+			cmd, data, err := c.read()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("read error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd != tt.wantCmd || string(data) != tt.wantData {
+				t.Errorf("read = %q %q, want %q %q", cmd, data, tt.wantCmd, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestMilterCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocol  uint32
+		wantSent  bool
+		wantReply []byte
+	}{
+		{"reply read", 0, true, []byte{milterReject}},
+		{"step skipped", milterNoHelo, false, []byte{milterContinue}},
+		{"no reply", milterNoReplyHelo, true, []byte{milterContinue}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := pipeMilterClient(t)
+			c.protocol = tt.protocol
+			sent := make(chan []byte, 1)
+			go func() {
+				buf := make([]byte, 64)
+				n, err := server.Read(buf)
+				if err != nil {
+					sent <- nil
+					return
+				}
+				sent <- buf[:n]
+				if tt.protocol&milterNoReplyHelo == 0 {
+					server.Write(milterPacket(milterReject, ""))
+				}
+			}()
+
+			reply, err := c.command(milterHelo, []byte("host\x00"), milterNoHelo, milterNoReplyHelo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply, tt.wantReply) {
+				t.Errorf("reply = %q, want %q", reply, tt.wantReply)
+			}
+			if !tt.wantSent {
+				server.Close() // Unblocks the reader
+			}
+			if got := <-sent; (got != nil) != tt.wantSent {
+				t.Errorf("command sent %q, want sent = %v", got, tt.wantSent)
+			} else if got != nil && !bytes.Equal(got, milterPacket(milterHelo, "host\x00")) {
+				t.Errorf("command sent %q", got)
+			}
+		})
+	}
+}
+
+func TestParseMilterReplyCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *smtp.SMTPError
+	}{
+		{"550 5.7.1 Spam detected", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Spam detected"}},
+		{"451 4.3.0 Try later", &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try later"}},
+		{"554 Go away", &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 0, 0}, Message: "Go away"}},
+		{"550 5.x.1 Odd code", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 0, 0}, Message: "5.x.1 Odd code"}},
+		{"250 ok", errMilterReject},
+		{"junk", errMilterReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var got *smtp.SMTPError
+			if !errors.As(parseMilterReplyCode(tt.in), &got) {
+				t.Fatalf("not an SMTP error")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMilterReplyCode(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMilterChangesHeader(t *testing.T) {
+	index := func(i uint32, rest string) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, i), rest...)
+	}
+	start := []headerField{{"From", "a@b"}, {"X-Tag", "one"}, {"X-Tag", "two"}}
+	tests := []struct {
+		name string
+		cmd  byte
+		data []byte
+		want []headerField
+	}{
+		{"add", milterAddHeader, []byte("X-New\x00v\x00"), append(append([]headerField{}, start...), headerField{"X-New", "v"})},
+		{"add folded", milterAddHeader, []byte("X-New\x00a\n\tb\x00"), append(append([]headerField{}, start...), headerField{"X-New", "a\r\n\tb"})},
+		{"insert first", milterInsHeader, index(0, "X-New\x00v\x00"), []headerField{{"X-New", "v"}, {"From", "a@b"}, {"X-Tag", "one"}, {"X-Tag", "two"}}},
+		{"insert past end", milterInsHeader, index(9, "X-New\x00v\x00"), append(append([]headerField{}, start...), headerField{"X-New", "v"})},
+		{"change second", milterChgHeader, index(2, "x-tag\x00three\x00"), []headerField{{"From", "a@b"}, {"X-Tag", "one"}, {"X-Tag", "three"}}},
+		{"delete first", milterChgHeader, index(1, "X-Tag\x00\x00"), []headerField{{"From", "a@b"}, {"X-Tag", "two"}}},
+		{"change missing adds", milterChgHeader, index(1, "X-Other\x00v\x00"), append(append([]headerField{}, start...), headerField{"X-Other", "v"})},
+		{"delete missing", milterChgHeader, index(3, "X-Tag\x00\x00"), start},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := &milterChanges{headers: append([]headerField{}, start...)}
+			ch.header(tt.cmd, tt.data)
+			if !reflect.DeepEqual(ch.headers, tt.want) {
+				t.Errorf("headers = %q, want %q", ch.headers, tt.want)
+			}
+			if !ch.headersDirty {
+				t.Error("headersDirty not set")
+			}
+		})
+	}
+}
+
+func TestChangeSender(t *testing.T) {
+	trans := &EmailTransaction{from: "app@contoso.com", returnPath: "app@contoso.com"}
+	trans.dsn.EnvelopeID, trans.dsn.Return = "old", "FULL"
+
+	// Without parameters the DSN parameters of MAIL FROM stay
+	changeSender(trans, []byte("<bounces@contoso.com>\x00"))
+	if trans.from != "bounces@contoso.com" || trans.returnPath != "bounces@contoso.com" {
+		t.Errorf("from %q, return path %q", trans.from, trans.returnPath)
+	}
+	if trans.dsn.EnvelopeID != "old" || trans.dsn.Return != "FULL" {
+		t.Errorf("DSN changed without parameters: %+v", trans.dsn)
+	}
+
+	changeSender(trans, []byte("<relay@contoso.com>\x00ENVID=a+2Bb+3Dc ret=hdrs SIZE=100\x00"))
+	if trans.returnPath != "relay@contoso.com" {
+		t.Errorf("return path %q", trans.returnPath)
+	}
+	if trans.dsn.EnvelopeID != "a+b=c" || trans.dsn.Return != "HDRS" {
+		t.Errorf("DSN = %+v, want ENVID a+b=c and RET HDRS", trans.dsn)
+	}
+
+	// Parameters replace those of MAIL FROM, so a missing one is cleared
+	changeSender(trans, []byte("<relay@contoso.com>\x00RET=FULL\x00"))
+	if trans.dsn.EnvelopeID != "" || trans.dsn.Return != "FULL" {
+		t.Errorf("DSN = %+v, want only RET FULL", trans.dsn)
+	}
+}
+
+func TestReadMilterHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     []headerField
+		wantBody string
+	}{
+		{"simple", "From: a@b\r\nSubject: hi\r\n\r\nbody\r\n", []headerField{{"From", "a@b"}, {"Subject", "hi"}}, "body\r\n"},
+		{"folded", "Subject: one\r\n two\r\n\r\nbody", []headerField{{"Subject", "one\r\n two"}}, "body"},
+		{"no space", "X-A:b\n\n", []headerField{{"X-A", "b"}}, ""},
+		{"no body", "From: a@b\r\n", []headerField{{"From", "a@b"}}, ""},
+		{"no header", "\r\nbody", nil, "body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			got, err := readMilterHeaders(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("headers = %q, want %q", got, tt.want)
+			}
+			if body, _ := io.ReadAll(r); string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Non-Delivery Reports ---
+//
+// With [NDR] Postmaster set, the relay tells the envelope sender about
+// messages it gives up on once the client is gone: mail received over SMTP
+// whose delivery failed permanently after QUIT, and spooled mail that failed
+// permanently or ran out of attempts. Mail received over SMTP that failed
+// temporarily is moved to the spool and retried. The report is an RFC 3464
+// multipart/report with an explanation, a message/delivery-status part with
+// a block per recipient and the header of the original message, sent from
+// the Postmaster mailbox.
+//
+// No report is sent for the null sender (MAIL FROM:<>), to the Postmaster
+// itself or about a message that was itself generated automatically, such
+// as another report, so two systems cannot bounce mail back and forth.
+
+// reportRecipient is the outcome for one recipient in a delivery report.
+type reportRecipient struct {
+	address    string
+	original   string // Original-Recipient, from ORCPT
+	action     string // "failed", "delayed" or "relayed"
+	status     string // Enhanced status code
+	diagnostic string // Diagnostic-Code, if any
+}
+
+// sendNDR reports to returnPath that the message in the file at path could
+// not be delivered to those recipients whose NOTIFY asks for it.
+func sendNDR(returnPath string, recipients []string, path string, dsn *messageDSN, cause error) {
+	status, diagnostic := errorStatus(cause, 5)
+	list := dsn.reportRecipients(recipients, smtp.DSNNotifyFailure, "failed", status, diagnostic)
+	if err := sendDeliveryReport(returnPath, path, dsn, list); err != nil {
+		logger.Printf("Failed to send non-delivery report to %s: %v", returnPath, err)
+	}
+}
+
+// deferOrReport handles a message received over SMTP whose delivery
+// failed after the client disconnected: a temporary failure moves it to the
+// spool to be retried, any other is reported to the sender.
+func deferOrReport(trans *EmailTransaction, cause error) {
+	if !trans.hasData() {
+		return
+	}
+	// Only the recipients of copies that failed are retried and reported
+	recipients := trans.to
+	if failed, delivered := partialDelivery(cause); failed != nil {
+		recipients = failed
+		trans.delivered = append(trans.delivered, delivered...)
+	}
+	if isTemporary(cause) && len(trans.to) > 0 {
+		entry, err := spoolTransaction(trans, cause)
+		if err == nil {
+			logger.Printf("[spool %s] Message from %s queued for retry at %s", entry.ID, trans.returnPath, entry.NextAttempt.Format(time.RFC3339))
+			sendDelayDSN(trans.returnPath, recipients, trans.dataPath, &trans.dsn, cause)
+			return
+		}
+		logger.Printf("Failed to spool message from %s for retry: %v", trans.returnPath, err)
+	}
+	sendNDR(trans.returnPath, recipients, trans.dataPath, &trans.dsn, cause)
+}
+
+// errorStatus returns the status, of the given class (4 while the relay
+// keeps trying, 5 once it gives up), and the diagnostic for a delivery that
+// failed with err.
+func errorStatus(err error, class int) (string, string) {
+	status := fmt.Sprintf("%d.0.0", class)
+	var se *smtp.SMTPError
+	if errors.As(err, &se) {
+		if se.EnhancedCode != smtp.NoEnhancedCode && se.EnhancedCode != smtp.EnhancedCodeNotSet {
+			status = fmt.Sprintf("%d.%d.%d", class, se.EnhancedCode[1], se.EnhancedCode[2])
+		}
+		return status, fmt.Sprintf("smtp; %d %s", se.Code, oneLine(se.Message))
+	}
+	return status, "X-Graph-Relay; " + oneLine(err.Error())
+}
+
+// oneLine folds s onto a single line, for use in a header field.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// sendDeliveryReport sends a report about the message in the file at path
+// to returnPath, unless that could start a loop. dsn, which may be nil,
+// holds the envelope ID and whether the whole message is returned.
+func sendDeliveryReport(returnPath, path string, dsn *messageDSN, recipients []reportRecipient) error {
+	if config.Postmaster == "" || len(recipients) == 0 {
+		return nil
+	}
+	returnPath = strings.Trim(returnPath, "<>")
+	if returnPath == "" {
+		logger.Printf("No delivery report sent: the message has the null sender")
+		return nil
+	}
+	if strings.EqualFold(returnPath, config.Postmaster) {
+		logger.Printf("No delivery report sent: the message is from the postmaster %s", returnPath)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h, err := textproto.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("invalid message header: %w", err)
+	}
+	header := mail.Header{Header: message.Header{Header: h}}
+	if auto := header.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(auto, "no") {
+		logger.Printf("No delivery report sent to %s: the message is Auto-Submitted: %s", returnPath, auto)
+		return nil
+	}
+	if t, _, _ := header.ContentType(); t == "multipart/report" {
+		logger.Printf("No delivery report sent to %s: the message is itself a report", returnPath)
+		return nil
+	}
+
+	workDir, err := createTempDir("report-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	host, _ := os.Hostname()
+	var status bytes.Buffer
+	if dsn != nil && dsn.EnvelopeID != "" {
+		fmt.Fprintf(&status, "Original-Envelope-Id: %s\r\n", dsn.EnvelopeID)
+	}
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", host)
+	for _, r := range recipients {
+		fmt.Fprintf(&status, "\r\n")
+		if r.original != "" {
+			fmt.Fprintf(&status, "Original-Recipient: %s\r\n", r.original)
+		}
+		fmt.Fprintf(&status, "Final-Recipient: rfc822; %s\r\n", r.address)
+		fmt.Fprintf(&status, "Action: %s\r\n", r.action)
+		fmt.Fprintf(&status, "Status: %s\r\n", r.status)
+		if r.diagnostic != "" {
+			fmt.Fprintf(&status, "Diagnostic-Code: %s\r\n", r.diagnostic)
+		}
+	}
+	statusPath := filepath.Join(workDir, "status")
+	if err := os.WriteFile(statusPath, status.Bytes(), 0600); err != nil {
+		return err
+	}
+	attachments := []Attachment{
+		{Name: "delivery-status.txt", ContentType: "message/delivery-status", Size: int64(status.Len()), path: statusPath},
+	}
+	full := dsn != nil && dsn.Return == string(smtp.DSNReturnFull)
+	if full {
+		// RET=FULL returns the whole message
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, Attachment{Name: "message.eml", ContentType: "message/rfc822", Size: info.Size(), path: path})
+	} else {
+		var headers bytes.Buffer
+		if err := textproto.WriteHeader(&headers, h); err != nil {
+			return err
+		}
+		headersPath := filepath.Join(workDir, "headers")
+		if err := os.WriteFile(headersPath, headers.Bytes(), 0600); err != nil {
+			return err
+		}
+		attachments = append(attachments, Attachment{Name: "headers.txt", ContentType: "text/rfc822-headers", Size: int64(headers.Len()), path: headersPath})
+	}
+
+	subject, _ := header.Subject()
+	var reportHeader mail.Header
+	if id := header.Get("Message-Id"); id != "" {
+		reportHeader.Set("In-Reply-To", id)
+		reportHeader.Set("References", id)
+	}
+	env := &Envelope{From: config.Postmaster, To: []string{returnPath}}
+	msg := &OutboundMessage{
+		Subject:         reportSubject(recipients) + ": " + subject,
+		BodyContentType: "Text",
+		Body:            reportText(host, recipients, full),
+		To:              []string{returnPath},
+		Attachments:     attachments,
+		Header:          reportHeader,
+		SetHeaders:      [][2]string{{"Auto-Submitted", "auto-replied"}},
+		ReportType:      "delivery-status",
+	}
+
+	// The report goes straight to the transport: if it fails, nothing is
+	// reported about the report
+	result, err := sendChunked(activeTransport, env, msg)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Delivery report for %d recipient(s) sent to %s (request-id %s)", len(recipients), returnPath, result.RequestID)
+	return nil
+}
+
+// reportSubject names the worst outcome among recipients.
+func reportSubject(recipients []reportRecipient) string {
+	subject := "Relayed"
+	for _, r := range recipients {
+		switch r.action {
+		case "failed":
+			return "Undeliverable"
+		case "delayed":
+			subject = "Delivery delayed"
+		}
+	}
+	return subject
+}
+
+// reportText is the human-readable part of a delivery report.
+func reportText(host string, recipients []reportRecipient, full bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is the mail relay at %s.\r\n", host)
+	for _, action := range []string{"failed", "delayed", "relayed"} {
+		first := true
+		for _, r := range recipients {
+			if r.action != action {
+				continue
+			}
+			if first {
+				switch action {
+				case "failed":
+					b.WriteString("\r\nYour message could not be delivered to the following recipients:\r\n\r\n")
+				case "delayed":
+					b.WriteString("\r\nDelivery of your message to the following recipients is delayed. The relay keeps trying:\r\n\r\n")
+				case "relayed":
+					b.WriteString("\r\nYour message was handed over for delivery to the following recipients. No further notifications will be sent:\r\n\r\n")
+				}
+				first = false
+			}
+			fmt.Fprintf(&b, "  %s", r.address)
+			if r.diagnostic != "" {
+				_, text, _ := strings.Cut(r.diagnostic, "; ")
+				fmt.Fprintf(&b, ": %s", text)
+			}
+			b.WriteString("\r\n")
+		}
+	}
+	if full {
+		b.WriteString("\r\nThe delivery status and your message are attached.\r\n")
+	} else {
+		b.WriteString("\r\nThe delivery status and the header of your message are attached.\r\n")
+	}
+	return b.String()
+}
+
+// writeReport writes msg as a multipart/report with header h: the body
+// followed by each attachment as a part of its content type.
+func writeReport(w io.Writer, h mail.Header, msg *OutboundMessage) error {
+	h.SetContentType("multipart/report", map[string]string{"report-type": msg.ReportType})
+	mw, err := message.CreateWriter(w, h.Header)
+	if err != nil {
+		return err
+	}
+
+	var th message.Header
+	th.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	th.Set("Content-Transfer-Encoding", "quoted-printable")
+	pw, err := mw.CreatePart(th)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(pw, msg.Body); err != nil {
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+
+	for _, a := range msg.Attachments {
+		var ph message.Header
+		ph.SetContentType(a.ContentType, nil)
+		pw, err := mw.CreatePart(ph)
+		if err != nil {
+			return err
+		}
+		if err := copyAttachment(pw, a); err != nil {
+			return err
+		}
+		if err := pw.Close(); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"net"
+	"strings"
+)
+
+// --- Recipient Policy ---
+//
+// [RecipientPolicy] limits where relayed mail may go:
+//
+//	[RecipientPolicy]
+//	AllowedDomains = contoso.com, fabrikam.com
+//	AllowedAddresses = orders@partner.example
+//	DeniedDomains = gmail.com
+//	DeniedAddresses = ceo@contoso.com
+//	InternalDomains = contoso.com
+//	InternalOnlySenders = scanner@contoso.com, @printer.local
+//	InternalOnlyNetworks = 10.20.0.0/16, 192.168.5.10
+//
+// A recipient is checked in this order: denied addresses, internal-only
+// restrictions, allowed addresses, denied domains, allowed domains. An empty
+// AllowedDomains allows every domain that is not denied.
+
+var errRecipientPolicy = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Recipient address rejected by relay policy",
+}
+
+// RecipientPolicy is the parsed [RecipientPolicy] section.
+type RecipientPolicy struct {
+	AllowedDomains       []string
+	AllowedAddresses     []string
+	DeniedDomains        []string
+	DeniedAddresses      []string
+	InternalDomains      []string // Empty means the tenants' domains, or the sender's own
+	InternalOnlySenders  []string // Addresses or @domain
+	InternalOnlyNetworks []*net.IPNet
+}
+
+func loadRecipientPolicy(sec *ini.Section) (RecipientPolicy, error) {
+	list := func(key string) []string {
+		var out []string
+		for _, v := range sec.Key(key).Strings(",") {
+			out = append(out, strings.ToLower(v))
+		}
+		return out
+	}
+	p := RecipientPolicy{
+		AllowedDomains:      list("AllowedDomains"),
+		AllowedAddresses:    list("AllowedAddresses"),
+		DeniedDomains:       list("DeniedDomains"),
+		DeniedAddresses:     list("DeniedAddresses"),
+		InternalDomains:     list("InternalDomains"),
+		InternalOnlySenders: list("InternalOnlySenders"),
+	}
+	for _, n := range sec.Key("InternalOnlyNetworks").Strings(",") {
+		if !strings.Contains(n, "/") {
+			if ip := net.ParseIP(n); ip != nil && ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return p, fmt.Errorf("RecipientPolicy.InternalOnlyNetworks: %w", err)
+		}
+		p.InternalOnlyNetworks = append(p.InternalOnlyNetworks, network)
+	}
+	return p, nil
+}
+
+// enabled reports whether the policy restricts anything.
+func (p *RecipientPolicy) enabled() bool {
+	return len(p.AllowedDomains) > 0 || len(p.AllowedAddresses) > 0 || len(p.DeniedDomains) > 0 ||
+		len(p.DeniedAddresses) > 0 || len(p.InternalOnlySenders) > 0 || len(p.InternalOnlyNetworks) > 0
+}
+
+// internalOnly reports why a sender or client is limited to internal
+// recipients, or "" when it is not.
+func (p *RecipientPolicy) internalOnly(sender string, client net.IP) string {
+	lower := strings.ToLower(sender)
+	for _, s := range p.InternalOnlySenders {
+		if s == lower || strings.HasPrefix(s, "@") && s[1:] == senderDomain(lower) {
+			return "sender " + sender + " is internal-only"
+		}
+	}
+	if client != nil {
+		for _, n := range p.InternalOnlyNetworks {
+			if n.Contains(client) {
+				return "client network " + n.String() + " is internal-only"
+			}
+		}
+	}
+	return ""
+}
+
+// isInternal reports whether domain counts as internal for sender.
+func (p *RecipientPolicy) isInternal(domain, sender string) bool {
+	if len(p.InternalDomains) > 0 {
+		return containsFold(p.InternalDomains, domain)
+	}
+	if len(config.Tenants) > 0 {
+		for _, t := range config.Tenants {
+			if containsFold(t.Domains, domain) {
+				return true
+			}
+		}
+		return false
+	}
+	return domain == senderDomain(sender)
+}
+
+// decide returns whether rcpt may receive mail from sender via client, and
+// the reason for the decision.
+func (p *RecipientPolicy) decide(sender string, client net.IP, rcpt string) (bool, string) {
+	addr := strings.ToLower(rcpt)
+	domain := senderDomain(addr)
+
+	if containsFold(p.DeniedAddresses, addr) {
+		return false, "address is denied"
+	}
+	if why := p.internalOnly(sender, client); why != "" && !p.isInternal(domain, sender) {
+		return false, why + " and " + domain + " is external"
+	}
+	if containsFold(p.AllowedAddresses, addr) {
+		return true, "address is allowed"
+	}
+	if containsFold(p.DeniedDomains, domain) {
+		return false, "domain " + domain + " is denied"
+	}
+	if len(p.AllowedDomains) > 0 {
+		if containsFold(p.AllowedDomains, domain) {
+			return true, "domain " + domain + " is allowed"
+		}
+		return false, "domain " + domain + " is not allowed"
+	}
+	return true, "no rule denies it"
+}
+
+// checkRecipient applies the recipient policy and logs the decision. It
+// returns errRecipientPolicy when rcpt must be rejected.
+func checkRecipient(sender string, client net.IP, rcpt string) error {
+	p := &config.RecipientPolicy
+	if !p.enabled() {
+		return nil
+	}
+	ok, reason := p.decide(sender, client, rcpt)
+	clientStr := "local"
+	if client != nil {
+		clientStr = client.String()
+	}
+	if !ok {
+		logger.Printf("Policy: rejected %s from %s (client %s): %s", rcpt, sender, clientStr, reason)
+		return errRecipientPolicy
+	}
+	logger.Printf("Policy: accepted %s from %s (client %s): %s", rcpt, sender, clientStr, reason)
+	return nil
+}
+
+// filterRecipients drops the addresses the policy rejects. It catches
+// recipients that did not pass through RCPT, such as header addresses added
+// after DATA.
+func filterRecipients(sender string, client net.IP, list []string) []string {
+	var out []string
+	for _, rcpt := range list {
+		if checkRecipient(sender, client, rcpt) == nil {
+			out = append(out, rcpt)
+		}
+	}
+	return out
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Quarantine ---
+//
+// Messages held back by policy are kept in [Quarantine] Directory instead of
+// being delivered. Like the spool, each message is stored as <id>.eml with
+// its envelope and the reason it was held in <id>.json, written last.
+//
+// The quarantine command lists, shows, releases and deletes messages.
+// Releasing a message spools it for delivery by the running relay, marked
+// so the policy that held it does not hold it again. Messages older than
+// [Quarantine] Retention are deleted by the spool worker.
+
+// quarantineEntry is the envelope of a quarantined message.
+type quarantineEntry struct {
+	ID         string      `json:"id"`
+	From       string      `json:"from"`       // Sender the message is delivered as
+	ReturnPath string      `json:"returnPath"` // MAIL FROM, which receives delivery reports
+	To         []string    `json:"to"`
+	ClientIP   string      `json:"clientIP,omitempty"`
+	AuthUser   string      `json:"authUser,omitempty"`
+	Created    time.Time   `json:"created"`
+	Reason     string      `json:"reason"`
+	DSN        *messageDSN `json:"dsn,omitempty"` // DSN parameters given over SMTP; see dsn.go
+}
+
+func quarantinePath(id, ext string) string {
+	return filepath.Join(config.QuarantineDirectory, id+ext)
+}
+
+// quarantineMessage stores the message of trans in the quarantine and
+// returns its ID.
+func quarantineMessage(trans *EmailTransaction, sender, reason string) (string, error) {
+	if err := os.MkdirAll(config.QuarantineDirectory, 0700); err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	entry := &quarantineEntry{
+		ID:         newSpoolID(),
+		From:       sender,
+		ReturnPath: trans.returnPath,
+		To:         trans.to,
+		AuthUser:   trans.authUser,
+		Created:    time.Now(),
+		Reason:     reason,
+	}
+	if trans.clientIP != nil {
+		entry.ClientIP = trans.clientIP.String()
+	}
+	if !trans.dsn.empty() {
+		dsn := trans.dsn
+		entry.DSN = &dsn
+	}
+
+	if err := copyDataTo(trans, quarantinePath(entry.ID, ".eml")); err != nil {
+		return "", fmt.Errorf("failed to write quarantined message: %w", err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(quarantinePath(entry.ID, ".json"), data); err != nil {
+		_ = os.Remove(quarantinePath(entry.ID, ".eml"))
+		return "", fmt.Errorf("failed to write quarantine envelope: %w", err)
+	}
+	logger.Printf("Quarantined message from %s to %v as %s: %s", sender, trans.to, entry.ID, reason)
+	return entry.ID, nil
+}
+
+// copyDataTo copies the stored message of trans to path, atomically.
+func copyDataTo(trans *EmailTransaction, path string) error {
+	src, err := trans.openData()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadQuarantineEntry(id string) (*quarantineEntry, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid quarantine ID %q", id)
+	}
+	data, err := os.ReadFile(quarantinePath(id, ".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no quarantined message %s", id)
+		}
+		return nil, err
+	}
+	var entry quarantineEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid quarantine envelope %s: %w", id, err)
+	}
+	return &entry, nil
+}
+
+// listQuarantine returns all complete quarantine entries, oldest first.
+func listQuarantine() ([]*quarantineEntry, error) {
+	files, err := filepath.Glob(filepath.Join(config.QuarantineDirectory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*quarantineEntry
+	for _, f := range files {
+		entry, err := loadQuarantineEntry(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			logger.Printf("Skipping quarantine entry %s: %v", f, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries, nil
+}
+
+func removeQuarantineEntry(id string) error {
+	if err := os.Remove(quarantinePath(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(quarantinePath(id, ".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// expireQuarantine deletes messages kept longer than [Quarantine] Retention.
+func expireQuarantine() {
+	if config.QuarantineRetention <= 0 {
+		return
+	}
+	entries, err := listQuarantine()
+	if err != nil {
+		logger.Printf("Failed to read quarantine: %v", err)
+		return
+	}
+	cutoff := time.Now().Add(-config.QuarantineRetention)
+	for _, entry := range entries {
+		if entry.Created.After(cutoff) {
+			continue
+		}
+		if err := removeQuarantineEntry(entry.ID); err != nil {
+			logger.Printf("[quarantine %s] Failed to delete expired message: %v", entry.ID, err)
+			continue
+		}
+		logger.Printf("[quarantine %s] Deleted after %v (from %s: %s)", entry.ID, config.QuarantineRetention, entry.From, entry.Reason)
+	}
+}
+
+// releaseQuarantined moves a quarantined message to the spool and returns
+// its spool ID.
+func releaseQuarantined(id string) (string, error) {
+	entry, err := loadQuarantineEntry(id)
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(quarantinePath(id, ".eml"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read quarantined message: %w", err)
+	}
+	// The spool keeps the envelope as received; delivery derives the sender
+	// from it again
+	spoolID, err := spoolEntryMessage(&spoolEntry{From: entry.ReturnPath, To: entry.To, ClientIP: entry.ClientIP, AuthUser: entry.AuthUser, DSN: entry.DSN, Released: true}, raw)
+	if err != nil {
+		return "", err
+	}
+	if err := removeQuarantineEntry(id); err != nil {
+		return spoolID, fmt.Errorf("released as %s but failed to remove %s from the quarantine: %w", spoolID, id, err)
+	}
+	logger.Printf("[quarantine %s] Released to the spool as %s", id, spoolID)
+	return spoolID, nil
+}
+
+// runQuarantine implements the quarantine command.
+func runQuarantine(args []string) error {
+	usage := fmt.Errorf("usage: quarantine list | show <id> | release <id> | delete <id>")
+	if len(args) == 0 {
+		return usage
+	}
+	expireQuarantine()
+
+	switch args[0] {
+	case "list":
+		entries, err := listQuarantine()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Println("The quarantine is empty.")
+			return nil
+		}
+		for _, e := range entries {
+			fmt.Printf("%s  %s  %s -> %s\n    %s\n", e.ID, e.Created.Format(time.RFC3339), e.From, strings.Join(e.To, ", "), e.Reason)
+		}
+		return nil
+
+	case "show":
+		if len(args) != 2 {
+			return usage
+		}
+		entry, err := loadQuarantineEntry(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ID:        %s\n", entry.ID)
+		fmt.Printf("Created:   %s\n", entry.Created.Format(time.RFC3339))
+		if config.QuarantineRetention > 0 {
+			fmt.Printf("Expires:   %s\n", entry.Created.Add(config.QuarantineRetention).Format(time.RFC3339))
+		}
+		fmt.Printf("From:      %s\n", entry.From)
+		if entry.ReturnPath != entry.From {
+			fmt.Printf("MAIL FROM: <%s>\n", entry.ReturnPath)
+		}
+		fmt.Printf("To:        %s\n", strings.Join(entry.To, ", "))
+		if entry.ClientIP != "" {
+			fmt.Printf("Client IP: %s\n", entry.ClientIP)
+		}
+		fmt.Printf("Reason:    %s\n\n", entry.Reason)
+		f, err := os.Open(quarantinePath(entry.ID, ".eml"))
+		if err != nil {
+			return fmt.Errorf("failed to read quarantined message: %w", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+
+	case "release":
+		if len(args) != 2 {
+			return usage
+		}
+		spoolID, err := releaseQuarantined(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Released %s; the relay delivers it from the spool as %s.\n", args[1], spoolID)
+		return nil
+
+	case "delete":
+		if len(args) != 2 {
+			return usage
+		}
+		if _, err := loadQuarantineEntry(args[1]); err != nil {
+			return err
+		}
+		if err := removeQuarantineEntry(args[1]); err != nil {
+			return err
+		}
+		logger.Printf("[quarantine %s] Deleted", args[1])
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A released message is spooled with the envelope it arrived with, so its
+// delivery reports go where the client asked.
+func TestReleaseQuarantinedKeepsEnvelope(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.QuarantineDirectory = t.TempDir()
+	config.SpoolDirectory = t.TempDir()
+	config.TempDirectory = t.TempDir()
+
+	trans := &EmailTransaction{returnPath: "bounces@contoso.com", to: []string{"ops@contoso.com"}}
+	trans.dsn.EnvelopeID = "env-42"
+	trans.dsn.Return = "FULL"
+	trans.dsn.Recipients = map[string]recipientDSN{"ops@contoso.com": {Notify: []string{"SUCCESS", "FAILURE"}}}
+	if err := trans.storeData(strings.NewReader("Subject: Held\r\n\r\nBody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer trans.discardData()
+
+	id, err := quarantineMessage(trans, "app@contoso.com", "attachment policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolID, err := releaseQuarantined(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := loadSpoolEntry(spoolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.From != "bounces@contoso.com" {
+		t.Errorf("spooled from %q, want the return path bounces@contoso.com", entry.From)
+	}
+	if !entry.Released {
+		t.Error("spool entry is not marked released")
+	}
+	if entry.DSN == nil {
+		t.Fatal("DSN parameters were lost")
+	}
+	if entry.DSN.EnvelopeID != "env-42" || entry.DSN.Return != "FULL" {
+		t.Errorf("DSN = %+v", entry.DSN)
+	}
+	if !entry.DSN.wants("ops@contoso.com", "SUCCESS") {
+		t.Error("NOTIFY=SUCCESS of ops@contoso.com was lost")
+	}
+}
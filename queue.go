@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- queue Command ---
+//
+// The queue command inspects and manages the spool: messages waiting for
+// delivery, being retried, held by an operator or given up on. Changes are
+// written to the envelope files, which the running relay reads on its next
+// pass. Each change is made under the message's lock, so it waits for a
+// delivery attempt in progress instead of being overwritten by it.
+
+// status describes where a spooled message stands.
+func (e *spoolEntry) status() string {
+	switch {
+	case e.Held:
+		return "held"
+	case e.Failed:
+		return "failed"
+	case e.Attempts > 0:
+		return "retrying"
+	}
+	return "queued"
+}
+
+// spoolSubject returns the subject of a spooled message, or "" if it cannot
+// be read.
+func spoolSubject(id string) string {
+	f, err := os.Open(spoolPath(id, ".eml"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h, err := textproto.ReadHeader(bufio.NewReader(f))
+	if err != nil {
+		return ""
+	}
+	subject, _ := (&mail.Header{Header: message.Header{Header: h}}).Subject()
+	return subject
+}
+
+// loadQueueEntry loads the spool entry named on the command line.
+func loadQueueEntry(id string) (*spoolEntry, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid queue ID %q", id)
+	}
+	entry, err := loadSpoolEntry(id)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no queued message %s", id)
+	}
+	return entry, err
+}
+
+// runQueue implements the queue command.
+func runQueue(args []string) error {
+	usage := fmt.Errorf("usage: queue list | show <id> | retry <id>|all | delete <id> | hold <id> | release <id>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := listSpool()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Println("The queue is empty.")
+			return nil
+		}
+		for _, e := range entries {
+			printQueueEntry(e)
+			fmt.Println()
+		}
+		fmt.Printf("%d message(s)\n", len(entries))
+		return nil
+
+	case "show":
+		if len(args) != 2 {
+			return usage
+		}
+		entry, err := loadQueueEntry(args[1])
+		if err != nil {
+			return err
+		}
+		printQueueEntry(entry)
+		fmt.Println()
+		f, err := os.Open(spoolPath(entry.ID, ".eml"))
+		if err != nil {
+			return fmt.Errorf("failed to read spooled message: %w", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+
+	case "retry":
+		if len(args) != 2 {
+			return usage
+		}
+		var entries []*spoolEntry
+		if args[1] == "all" {
+			all, err := listSpool()
+			if err != nil {
+				return err
+			}
+			for _, e := range all {
+				if !e.Held {
+					entries = append(entries, e)
+				}
+			}
+		} else {
+			entry, err := loadQueueEntry(args[1])
+			if err != nil {
+				return err
+			}
+			if entry.Held {
+				return fmt.Errorf("%s is held; use queue release", entry.ID)
+			}
+			entries = append(entries, entry)
+		}
+		retried := 0
+		for _, e := range entries {
+			err := withSpoolEntry(e.ID, func(e *spoolEntry) error {
+				if e.Held {
+					return nil
+				}
+				// A fresh set of attempts, so the next temporary failure
+				// does not give up again at once. A message that gave up
+				// was reported as failed; a new delay is reported again.
+				if e.Failed {
+					e.DelayReported = false
+				}
+				e.Failed = false
+				e.Attempts = 0
+				e.NextAttempt = time.Now()
+				if err := saveSpoolEntry(e); err != nil {
+					return err
+				}
+				retried++
+				logger.Printf("[spool %s] Scheduled for immediate retry", e.ID)
+				return nil
+			})
+			if os.IsNotExist(err) {
+				continue // Delivered or deleted meanwhile
+			}
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d message(s) will be retried on the relay's next pass.\n", retried)
+		return nil
+
+	case "delete":
+		if len(args) != 2 {
+			return usage
+		}
+		entry, err := loadQueueEntry(args[1])
+		if err != nil {
+			return err
+		}
+		err = withSpoolEntry(entry.ID, func(entry *spoolEntry) error {
+			if err := removeSpoolEntry(entry.ID); err != nil {
+				return err
+			}
+			logger.Printf("[spool %s] Deleted (from %s to %v)", entry.ID, entry.From, entry.To)
+			return nil
+		})
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no queued message %s", entry.ID)
+		}
+		return err
+
+	case "hold", "release":
+		if len(args) != 2 {
+			return usage
+		}
+		entry, err := loadQueueEntry(args[1])
+		if err != nil {
+			return err
+		}
+		err = withSpoolEntry(entry.ID, func(entry *spoolEntry) error {
+			entry.Held = args[0] == "hold"
+			if !entry.Held {
+				entry.NextAttempt = time.Now()
+			}
+			if err := saveSpoolEntry(entry); err != nil {
+				return err
+			}
+			if entry.Held {
+				logger.Printf("[spool %s] Held", entry.ID)
+			} else {
+				logger.Printf("[spool %s] Released", entry.ID)
+			}
+			return nil
+		})
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no queued message %s", entry.ID)
+		}
+		return err
+	}
+	return usage
+}
+
+func printQueueEntry(e *spoolEntry) {
+	fmt.Printf("%s  %s  %s\n", e.ID, e.Created.Format(time.RFC3339), e.status())
+	fmt.Printf("  From:       %s\n", e.From)
+	fmt.Printf("  To:         %s\n", strings.Join(e.To, ", "))
+	fmt.Printf("  Subject:    %s\n", spoolSubject(e.ID))
+	fmt.Printf("  Attempts:   %d\n", e.Attempts)
+	if e.LastError != "" {
+		fmt.Printf("  Last error: %s\n", e.LastError)
+	}
+	if !e.Held && !e.Failed {
+		fmt.Printf("  Next retry: %s\n", e.NextAttempt.Format(time.RFC3339))
+	}
+}
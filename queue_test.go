@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueRetry(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.SpoolDirectory = t.TempDir()
+	config.SpoolMaxAttempts = 5
+
+	later := time.Now().Add(time.Hour)
+	entries := []*spoolEntry{
+		{ID: "gave-up", Attempts: 5, Failed: true, DelayReported: true, NextAttempt: later},
+		{ID: "retrying", Attempts: 3, DelayReported: true, NextAttempt: later},
+		{ID: "held", Attempts: 2, Held: true, NextAttempt: later},
+	}
+	for _, e := range entries {
+		if err := saveSpoolEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runQueue([]string{"retry", "held"}); err == nil {
+		t.Error("retry of a held message succeeded")
+	}
+	if err := runQueue([]string{"retry", "all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []spoolEntry{
+		// The message that gave up gets fresh attempts and may report a
+		// delay again; the sender was told it failed
+		{ID: "gave-up", Attempts: 0, DelayReported: false},
+		{ID: "retrying", Attempts: 0, DelayReported: true},
+		{ID: "held", Attempts: 2, Held: true},
+	} {
+		e, err := loadSpoolEntry(want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Failed || e.Attempts != want.Attempts || e.DelayReported != want.DelayReported || e.Held != want.Held {
+			t.Errorf("%s: %+v", want.ID, e)
+		}
+		if due := !e.NextAttempt.After(time.Now()); due == want.Held {
+			t.Errorf("%s: next attempt %v", want.ID, e.NextAttempt)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// --- Address Rewriting ---
+//
+// [Rewrite] MapFile names a canonical map with one rule per line:
+//
+//	# scope      pattern                  replacement
+//	sender       scanner@printer.local    scanner@contoso.com
+//	sender       @printer.local           noreply@contoso.com
+//	recipient    @internal.local          @contoso.com
+//	both         /^(.+)\.old@contoso\.com$/  $1@contoso.com
+//
+// Patterns are an exact address, a domain wildcard (@domain) or a regular
+// expression between slashes. A replacement starting with @ only replaces
+// the domain. Exact rules win over domain rules, which win over regular
+// expressions; within a kind the first matching line is used.
+
+// rewriteRule is one line of the map file.
+type rewriteRule struct {
+	pattern     string // Lower-cased address or @domain; empty for regexp rules
+	re          *regexp.Regexp
+	replacement string
+}
+
+// rewriteMap holds the rules of one scope.
+type rewriteMap struct {
+	exact   map[string]string
+	domains map[string]string
+	regexps []rewriteRule
+}
+
+func newRewriteMap() *rewriteMap {
+	return &rewriteMap{exact: make(map[string]string), domains: make(map[string]string)}
+}
+
+var (
+	senderRewrites    = newRewriteMap()
+	recipientRewrites = newRewriteMap()
+)
+
+func (m *rewriteMap) add(rule rewriteRule) {
+	switch {
+	case rule.re != nil:
+		m.regexps = append(m.regexps, rule)
+	case strings.HasPrefix(rule.pattern, "@"):
+		if _, ok := m.domains[rule.pattern]; !ok {
+			m.domains[rule.pattern] = rule.replacement
+		}
+	default:
+		if _, ok := m.exact[rule.pattern]; !ok {
+			m.exact[rule.pattern] = rule.replacement
+		}
+	}
+}
+
+// rewrite returns the rewritten address, or address itself when no rule matches.
+func (m *rewriteMap) rewrite(address string) string {
+	lower := strings.ToLower(address)
+	if repl, ok := m.exact[lower]; ok {
+		return applyReplacement(address, repl)
+	}
+	if repl, ok := m.domains["@"+senderDomain(lower)]; ok {
+		return applyReplacement(address, repl)
+	}
+	for _, rule := range m.regexps {
+		if rule.re.MatchString(address) {
+			return rule.re.ReplaceAllString(address, rule.replacement)
+		}
+	}
+	return address
+}
+
+// applyReplacement replaces the whole address, or only its domain when the
+// replacement is @domain.
+func applyReplacement(address, repl string) string {
+	if strings.HasPrefix(repl, "@") {
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			return address[:at] + repl
+		}
+		return address + repl
+	}
+	return repl
+}
+
+// loadRewriteMaps reads the map file into the sender and recipient maps.
+// An empty path disables rewriting.
+func loadRewriteMaps(path string) error {
+	senders, recipients := newRewriteMap(), newRewriteMap()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open rewrite map: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			fields := strings.Fields(text)
+			if len(fields) != 3 {
+				return fmt.Errorf("%s:%d: expected <scope> <pattern> <replacement>", path, line)
+			}
+			rule := rewriteRule{replacement: fields[2]}
+			if p := fields[1]; len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+				re, err := regexp.Compile("(?i)" + p[1:len(p)-1])
+				if err != nil {
+					return fmt.Errorf("%s:%d: invalid regular expression: %w", path, line, err)
+				}
+				rule.re = re
+			} else {
+				rule.pattern = strings.ToLower(p)
+			}
+
+			switch strings.ToLower(fields[0]) {
+			case "sender":
+				senders.add(rule)
+			case "recipient":
+				recipients.add(rule)
+			case "both":
+				senders.add(rule)
+				recipients.add(rule)
+			default:
+				return fmt.Errorf("%s:%d: unknown scope %q (want sender, recipient or both)", path, line, fields[0])
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read rewrite map: %w", err)
+		}
+	}
+	senderRewrites, recipientRewrites = senders, recipients
+	return nil
+}
+
+// canonicalSender rewrites an envelope or header sender. The default sender
+// is used when there is no sender or, with tenants configured, when no
+// tenant serves the rewritten address. It runs several times per
+// transaction, so it only logs at debug level; processEmail logs the result.
+func canonicalSender(from string) string {
+	rewritten := from
+	if from != "" {
+		rewritten = senderRewrites.rewrite(from)
+		if rewritten != from {
+			debugLog("Rewrote sender %s -> %s", from, rewritten)
+		}
+	}
+	if config.DefaultSender != "" && (rewritten == "" || len(config.Tenants) > 0 && tenantForSender(rewritten) == nil) {
+		debugLog("Using default sender %s for %q", config.DefaultSender, rewritten)
+		rewritten = config.DefaultSender
+	}
+	return rewritten
+}
+
+// canonicalRecipients rewrites a recipient list, dropping addresses that
+// become duplicates.
+func canonicalRecipients(list []string) []string {
+	var out []string
+	for _, rcpt := range list {
+		rewritten := recipientRewrites.rewrite(rcpt)
+		if rewritten != rcpt {
+			logger.Printf("Rewrote recipient %s -> %s", rcpt, rewritten)
+		}
+		if !containsFold(out, rewritten) {
+			out = append(out, rewritten)
+		}
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestRewriteMaps writes content to a map file and loads it.
+func loadTestRewriteMaps(t *testing.T, content string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "canonical")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadRewriteMaps("") })
+	return loadRewriteMaps(path)
+}
+
+func TestLoadRewriteMaps(t *testing.T) {
+	content := `# scope pattern replacement
+
+Sender     a@b             c@d
+RECIPIENT  @x              @y
+both       /^(.+)@z$/      $1@y
+sender     A@B             ignored@d
+`
+	if err := loadTestRewriteMaps(t, content); err != nil {
+		t.Fatal(err)
+	}
+	if len(senderRewrites.exact) != 1 || len(senderRewrites.regexps) != 1 || len(senderRewrites.domains) != 0 {
+		t.Errorf("sender map = %+v", senderRewrites)
+	}
+	if len(recipientRewrites.domains) != 1 || len(recipientRewrites.regexps) != 1 || len(recipientRewrites.exact) != 0 {
+		t.Errorf("recipient map = %+v", recipientRewrites)
+	}
+
+	invalid := map[string]string{
+		"sender a@b\n":              ":1: expected <scope> <pattern> <replacement>",
+		"sender a@b c@d e@f\n":      "expected <scope> <pattern> <replacement>",
+		"# first\nheader a@b c@d\n": `:2: unknown scope "header"`,
+		"sender /(/ x@y\n":          "invalid regular expression",
+	}
+	for content, wantErr := range invalid {
+		err := loadTestRewriteMaps(t, content)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("loading %q: error = %v, want %q", content, err, wantErr)
+		}
+	}
+
+	// A failed load keeps the maps in effect
+	if senderRewrites.rewrite("a@b") != "c@d" {
+		t.Error("maps replaced by a failed load")
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	const content = `sender     /^scan.*@printer\.local$/     regexp@contoso.com
+sender     @printer.local                 noreply@contoso.com
+sender     Scanner@Printer.local          scanner@contoso.com
+sender     @printer.local                 ignored@contoso.com
+recipient  @internal.local                @contoso.com
+both       /^(.+)\.old@contoso\.com$/     $1@contoso.com
+both       /^(.+)@old\.contoso\.com$/     $1@fabrikam.com
+`
+	if err := loadTestRewriteMaps(t, content); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		m       *rewriteMap
+		address string
+		want    string
+	}{
+		{"exact before domain and regexp", senderRewrites, "SCANNER@printer.local", "scanner@contoso.com"},
+		{"domain before regexp", senderRewrites, "scan2@printer.local", "noreply@contoso.com"},
+		{"first domain line wins", senderRewrites, "fax@PRINTER.local", "noreply@contoso.com"},
+		{"no match", senderRewrites, "alice@contoso.com", "alice@contoso.com"},
+		{"domain replacement keeps local part", recipientRewrites, "Alice@internal.local", "Alice@contoso.com"},
+		{"sender rule not used for recipients", recipientRewrites, "fax@printer.local", "fax@printer.local"},
+		{"regexp in both scopes", senderRewrites, "bob.old@contoso.com", "bob@contoso.com"},
+		{"regexp in both scopes", recipientRewrites, "bob.old@contoso.com", "bob@contoso.com"},
+		{"first regexp wins", recipientRewrites, "x.old@old.contoso.com", "x.old@fabrikam.com"},
+		{"regexp ignores case", recipientRewrites, "Bob.OLD@Contoso.com", "Bob@contoso.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.rewrite(tt.address); got != tt.want {
+				t.Errorf("rewrite(%q) = %q, want %q", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyReplacement(t *testing.T) {
+	tests := []struct {
+		address, repl, want string
+	}{
+		{"alice@internal.local", "@contoso.com", "alice@contoso.com"},
+		{"alice", "@contoso.com", "alice@contoso.com"},
+		{"alice@internal.local", "bob@contoso.com", "bob@contoso.com"},
+	}
+	for _, tt := range tests {
+		if got := applyReplacement(tt.address, tt.repl); got != tt.want {
+			t.Errorf("applyReplacement(%q, %q) = %q, want %q", tt.address, tt.repl, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalSender(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	if err := loadTestRewriteMaps(t, "sender @printer.local scanner@fabrikam.com\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	contoso := []TenantConfig{{Name: "contoso", Domains: []string{"contoso.com"}}}
+	tests := []struct {
+		name          string
+		defaultSender string
+		tenants       []TenantConfig
+		from          string
+		want          string
+	}{
+		{"unchanged", "", nil, "alice@contoso.com", "alice@contoso.com"},
+		{"rewritten", "", nil, "fax@printer.local", "scanner@fabrikam.com"},
+		{"empty stays empty", "", nil, "", ""},
+		{"default for empty", "noreply@contoso.com", nil, "", "noreply@contoso.com"},
+		{"default unused without tenants", "noreply@contoso.com", nil, "alice@fabrikam.com", "alice@fabrikam.com"},
+		{"served by a tenant", "noreply@contoso.com", contoso, "alice@contoso.com", "alice@contoso.com"},
+		{"default for unserved", "noreply@contoso.com", contoso, "alice@fabrikam.com", "noreply@contoso.com"},
+		{"default after rewrite", "noreply@contoso.com", contoso, "fax@printer.local", "noreply@contoso.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DefaultSender, config.Tenants = tt.defaultSender, tt.tenants
+			if got := canonicalSender(tt.from); got != tt.want {
+				t.Errorf("canonicalSender(%q) = %q, want %q", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalRecipients(t *testing.T) {
+	if err := loadTestRewriteMaps(t, "recipient @internal.local @contoso.com\n"); err != nil {
+		t.Fatal(err)
+	}
+	got := canonicalRecipients([]string{"alice@internal.local", "bob@contoso.com", "Alice@contoso.com", "bob@internal.local"})
+	want := []string{"alice@contoso.com", "bob@contoso.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("canonicalRecipients = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// --- Message Rules ---
+//
+// [Rules] File names an ordered rules file. Each section is a rule; keys
+// that are conditions must all match for its actions to apply:
+//
+//	[tag-scanner-mail]
+//	Sender = @printer.local
+//	Subject = /^scan/
+//	PrefixSubject = "[Scan] "
+//	AddRecipient = archive@contoso.com
+//
+//	[drop-monitoring-noise]
+//	ClientIP = 10.20.30.40
+//	Header = X-Monitor-Alert
+//	Action = discard
+//
+// Rules are evaluated in file order and every matching rule applies, until
+// one has Stop = true or rejects or discards the message. Mail received
+// over SMTP is evaluated at the end of DATA, so rejections reach the
+// client; other mail is evaluated in processEmail.
+
+// addressPattern is an exact address, @domain or /regex/.
+type addressPattern struct {
+	literal string
+	re      *regexp.Regexp
+}
+
+func parseAddressPattern(p string) (addressPattern, error) {
+	if len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		re, err := regexp.Compile("(?i)" + p[1:len(p)-1])
+		return addressPattern{re: re}, err
+	}
+	return addressPattern{literal: strings.ToLower(p)}, nil
+}
+
+func (p addressPattern) match(address string) bool {
+	if p.re != nil {
+		return p.re.MatchString(address)
+	}
+	lower := strings.ToLower(address)
+	if strings.HasPrefix(p.literal, "@") {
+		return "@"+senderDomain(lower) == p.literal
+	}
+	return lower == p.literal
+}
+
+// headerCondition requires a header, optionally with a value matching re.
+type headerCondition struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// messageRule is one section of the rules file.
+type messageRule struct {
+	name string
+
+	// Conditions
+	senders    []addressPattern
+	recipients []addressPattern // Any recipient matching is enough
+	networks   []*net.IPNet
+	authUsers  []string
+	subject    *regexp.Regexp
+	headers    []headerCondition
+	minSize    int64
+	maxSize    int64
+
+	// Actions
+	action        string // "", "reject" or "discard"
+	message       string // Reply text for reject
+	redirect      []string
+	addRecipients []string
+	setHeaders    [][2]string
+	subjectPrefix string
+	tenant        string
+	transport     Transport
+	importance    string
+	stop          bool
+}
+
+// ruleOutcome is the combined effect of the rules matching a message.
+type ruleOutcome struct {
+	matched       []string
+	reject        string // Reply text, if the message is rejected
+	discard       bool
+	redirect      []string
+	addRecipients []string
+	setHeaders    [][2]string
+	subjectPrefix string
+	tenant        string
+	transport     Transport
+	importance    string
+}
+
+var messageRules []*messageRule
+
+// ruleKeys are the keys a rule may have.
+var ruleKeys = []string{
+	"Sender", "Recipient", "ClientIP", "AuthUser", "Subject", "Header", "MinSize", "MaxSize",
+	"Action", "Message", "Redirect", "AddRecipient", "SetHeader", "PrefixSubject", "Tenant", "Transport", "Importance", "Stop",
+}
+
+// loadRules reads the rules file. Transport names refer to [Target.<name>]
+// sections of cfg. An empty path disables rules.
+func loadRules(path string, cfg *ini.File) error {
+	messageRules = nil
+	if path == "" {
+		return nil
+	}
+	file, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, path)
+	if err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+
+	var rules []*messageRule
+	for _, sec := range file.Sections() {
+		if sec.Name() == ini.DefaultSection {
+			continue
+		}
+		r, err := parseRule(sec, cfg)
+		if err != nil {
+			return fmt.Errorf("%s: rule %s: %w", path, sec.Name(), err)
+		}
+		rules = append(rules, r)
+	}
+	messageRules = rules
+	logger.Printf("Loaded %d rule(s) from %s", len(rules), path)
+	return nil
+}
+
+func parseRule(sec *ini.Section, cfg *ini.File) (*messageRule, error) {
+	r := &messageRule{name: sec.Name()}
+	for _, key := range sec.KeyStrings() {
+		if !containsFold(ruleKeys, key) {
+			return nil, fmt.Errorf("unknown key %s", key)
+		}
+	}
+	// values returns every value of a key, split on commas.
+	values := func(key string) []string {
+		var out []string
+		for _, v := range sec.Key(key).ValueWithShadows() {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					out = append(out, item)
+				}
+			}
+		}
+		return out
+	}
+
+	for _, key := range []string{"Sender", "Recipient"} {
+		for _, v := range values(key) {
+			p, err := parseAddressPattern(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if key == "Sender" {
+				r.senders = append(r.senders, p)
+			} else {
+				r.recipients = append(r.recipients, p)
+			}
+		}
+	}
+	for _, n := range values("ClientIP") {
+		if !strings.Contains(n, "/") {
+			if ip := net.ParseIP(n); ip != nil && ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("ClientIP: %w", err)
+		}
+		r.networks = append(r.networks, network)
+	}
+	r.authUsers = values("AuthUser")
+	if s := sec.Key("Subject").String(); s != "" {
+		re, err := regexp.Compile("(?i)" + strings.TrimSuffix(strings.TrimPrefix(s, "/"), "/"))
+		if err != nil {
+			return nil, fmt.Errorf("Subject: %w", err)
+		}
+		r.subject = re
+	}
+	for _, h := range sec.Key("Header").ValueWithShadows() {
+		if h == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(h, ":")
+		c := headerCondition{name: strings.TrimSpace(name)}
+		if value = strings.TrimSpace(value); hasValue && value != "" {
+			re, err := regexp.Compile("(?i)" + strings.TrimSuffix(strings.TrimPrefix(value, "/"), "/"))
+			if err != nil {
+				return nil, fmt.Errorf("Header: %w", err)
+			}
+			c.re = re
+		}
+		r.headers = append(r.headers, c)
+	}
+	r.minSize = sec.Key("MinSize").MustInt64(0)
+	r.maxSize = sec.Key("MaxSize").MustInt64(0)
+
+	r.action = strings.ToLower(sec.Key("Action").String())
+	if r.action != "" && r.action != actionReject && r.action != "discard" {
+		return nil, fmt.Errorf("Action must be reject or discard")
+	}
+	r.message = sec.Key("Message").MustString("Message rejected by relay rules")
+	r.redirect = values("Redirect")
+	r.addRecipients = values("AddRecipient")
+	for _, h := range sec.Key("SetHeader").ValueWithShadows() {
+		if h == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("SetHeader must be Name: value")
+		}
+		r.setHeaders = append(r.setHeaders, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	r.subjectPrefix = sec.Key("PrefixSubject").String()
+
+	if r.tenant = sec.Key("Tenant").String(); r.tenant != "" && tenantByName(r.tenant) == nil {
+		return nil, fmt.Errorf("no [Tenant.%s] section", r.tenant)
+	}
+	if name := sec.Key("Transport").String(); name != "" {
+		if !cfg.HasSection("Target." + name) {
+			return nil, fmt.Errorf("no [Target.%s] section", name)
+		}
+		t, err := newTransport(loadTargetConfig(cfg.Section("Target."+name), name))
+		if err != nil {
+			return nil, fmt.Errorf("Transport: %w", err)
+		}
+		r.transport = t
+	}
+	if r.importance = strings.ToLower(sec.Key("Importance").String()); r.importance != "" &&
+		r.importance != "low" && r.importance != "normal" && r.importance != "high" {
+		return nil, fmt.Errorf("Importance must be low, normal or high")
+	}
+	r.stop = sec.Key("Stop").MustBool(false)
+	return r, nil
+}
+
+// tenantByName returns the [Tenant.<name>] tenant, or nil.
+func tenantByName(name string) *TenantConfig {
+	for i := range config.Tenants {
+		if strings.EqualFold(config.Tenants[i].Name, name) {
+			return &config.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// matches reports whether every condition of the rule holds for trans,
+// whose message has the given header.
+func (r *messageRule) matches(trans *EmailTransaction, header mail.Header) bool {
+	if len(r.senders) > 0 && !matchAny(r.senders, trans.returnPath) {
+		return false
+	}
+	if len(r.recipients) > 0 {
+		found := false
+		for _, rcpt := range trans.to {
+			if matchAny(r.recipients, rcpt) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.networks) > 0 {
+		found := false
+		for _, n := range r.networks {
+			if trans.clientIP != nil && n.Contains(trans.clientIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.authUsers) > 0 && !containsFold(r.authUsers, trans.authUser) {
+		return false
+	}
+	if r.subject != nil {
+		subject, _ := header.Subject()
+		if !r.subject.MatchString(subject) {
+			return false
+		}
+	}
+	for _, c := range r.headers {
+		if !header.Has(c.name) {
+			return false
+		}
+		if c.re != nil {
+			value, _ := header.Text(c.name)
+			if !c.re.MatchString(value) {
+				return false
+			}
+		}
+	}
+	if r.minSize > 0 && trans.dataSize < r.minSize {
+		return false
+	}
+	if r.maxSize > 0 && trans.dataSize > r.maxSize {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []addressPattern, address string) bool {
+	for _, p := range patterns {
+		if p.match(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateRules applies the rules to trans and logs every match.
+func evaluateRules(trans *EmailTransaction, header mail.Header) *ruleOutcome {
+	out := &ruleOutcome{}
+	for _, r := range messageRules {
+		if !r.matches(trans, header) {
+			continue
+		}
+		logger.Printf("Rule %s matched message from %s to %v", r.name, trans.returnPath, trans.to)
+		out.matched = append(out.matched, r.name)
+
+		switch r.action {
+		case actionReject:
+			out.reject = r.message
+			return out
+		case "discard":
+			out.discard = true
+			return out
+		}
+		if r.redirect != nil {
+			out.redirect = r.redirect
+		}
+		out.addRecipients = append(out.addRecipients, r.addRecipients...)
+		out.setHeaders = append(out.setHeaders, r.setHeaders...)
+		out.subjectPrefix += r.subjectPrefix
+		if r.tenant != "" {
+			out.tenant = r.tenant
+		}
+		if r.transport != nil {
+			out.transport = r.transport
+		}
+		if r.importance != "" {
+			out.importance = r.importance
+		}
+		if r.stop {
+			break
+		}
+	}
+	return out
+}
+
+// applyRulesAtData evaluates the rules at the end of DATA and returns the
+// SMTP error a rejected message is refused with.
+func applyRulesAtData(trans *EmailTransaction, header mail.Header) error {
+	if len(messageRules) == 0 {
+		return nil
+	}
+	trans.rules = evaluateRules(trans, header)
+	if trans.rules.reject != "" {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: trans.rules.reject}
+	}
+	return nil
+}
+
+// prefixSubject adds the prefix unless the subject already starts with it,
+// so a reply does not collect one prefix per round trip.
+func prefixSubject(subject, prefix string) string {
+	if prefix == "" || strings.HasPrefix(subject, prefix) {
+		return subject
+	}
+	return prefix + subject
+}
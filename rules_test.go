@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/emersion/go-message/mail"
+	"gopkg.in/ini.v1"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestRules writes content to a rules file and loads it.
+func loadTestRules(t *testing.T, content string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.ini")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { messageRules = nil })
+	return loadRules(path, ini.Empty())
+}
+
+func TestLoadRules(t *testing.T) {
+	if err := loadTestRules(t, "[a]\nSender = @printer.local\nRecipient = x@y\nRecipient = z@y, w@y\n[b]\nAction = Discard\n"); err != nil {
+		t.Fatal(err)
+	}
+	if len(messageRules) != 2 {
+		t.Fatalf("loaded %d rules, want 2", len(messageRules))
+	}
+	if a, b := messageRules[0], messageRules[1]; a.name != "a" || len(a.recipients) != 3 || b.action != "discard" {
+		t.Errorf("rules = %+v, %+v", a, b)
+	}
+
+	invalid := map[string]string{
+		"[a]\nSendr = x@y\n":               "rule a: unknown key Sendr",
+		"[a]\nAction = bounce\n":           "Action must be reject or discard",
+		"[a]\nSubject = /(/\n":             "Subject:",
+		"[a]\nSender = /[/\n":              "Sender:",
+		"[a]\nClientIP = 10.0.0.0/33\n":    "ClientIP:",
+		"[a]\nSetHeader = no colon\n":      "SetHeader must be Name: value",
+		"[a]\nImportance = urgent\n":       "Importance must be low, normal or high",
+		"[a]\nTenant = nowhere\n":          "no [Tenant.nowhere] section",
+		"[ok]\n[b]\nTransport = nowhere\n": "rule b: no [Target.nowhere] section",
+	}
+	for content, wantErr := range invalid {
+		err := loadTestRules(t, content)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("loading %q: error = %v, want %q", content, err, wantErr)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	var header mail.Header
+	header.SetSubject("Scan from printer")
+	header.Set("X-Monitor-Alert", "disk full")
+
+	trans := func() *EmailTransaction {
+		return &EmailTransaction{
+			from:       "Header@Contoso.com",
+			returnPath: "Scanner@Printer.local",
+			to:         []string{"alice@contoso.com", "bob@fabrikam.com"},
+			clientIP:   net.ParseIP("10.20.30.40"),
+			authUser:   "svc-scan",
+			dataSize:   2048,
+		}
+	}
+	tests := []struct {
+		name string
+		rule string
+		want bool
+	}{
+		{"no conditions", "", true},
+		{"exact sender", "Sender = scanner@printer.local", true},
+		{"sender is the envelope sender", "Sender = header@contoso.com", false},
+		{"sender domain", "Sender = @printer.local", true},
+		{"sender other domain", "Sender = @contoso.com", false},
+		{"sender regexp", "Sender = /^scan.*@/", true},
+		{"any recipient", "Recipient = nobody@x, @fabrikam.com", true},
+		{"no recipient", "Recipient = @northwind.com", false},
+		{"client network", "ClientIP = 10.20.0.0/16", true},
+		{"client address", "ClientIP = 10.20.30.40", true},
+		{"other client", "ClientIP = 192.168.0.0/16", false},
+		{"auth user", "AuthUser = SVC-SCAN", true},
+		{"other auth user", "AuthUser = root", false},
+		{"subject", "Subject = /^scan/", true},
+		{"subject without slashes", "Subject = printer", true},
+		{"other subject", "Subject = invoice", false},
+		{"header present", "Header = X-Monitor-Alert", true},
+		{"header value", "Header = X-Monitor-Alert: /disk/", true},
+		{"header other value", "Header = X-Monitor-Alert: cpu", false},
+		{"header missing", "Header = X-Other", false},
+		{"min size", "MinSize = 1024", true},
+		{"below min size", "MinSize = 4096", false},
+		{"above max size", "MaxSize = 1024", false},
+		{"all hold", "Sender = @printer.local\nSubject = scan\nClientIP = 10.0.0.0/8", true},
+		{"one fails", "Sender = @printer.local\nSubject = invoice", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := loadTestRules(t, "[r]\n"+tt.rule+"\n"); err != nil {
+				t.Fatal(err)
+			}
+			if got := messageRules[0].matches(trans(), header); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	var header mail.Header
+	header.SetSubject("Report")
+	trans := &EmailTransaction{returnPath: "app@contoso.com", to: []string{"ops@contoso.com"}}
+
+	tests := []struct {
+		name  string
+		rules string
+		want  *ruleOutcome
+	}{
+		{
+			"no match",
+			"[a]\nSender = @fabrikam.com\nAction = reject\n",
+			&ruleOutcome{},
+		},
+		{
+			"actions combine",
+			"[a]\nPrefixSubject = \"[A] \"\nAddRecipient = x@contoso.com\n" +
+				"[b]\nPrefixSubject = \"[B] \"\nAddRecipient = y@contoso.com\nSetHeader = X-Rule: b\nImportance = High\n",
+			&ruleOutcome{
+				matched:       []string{"a", "b"},
+				addRecipients: []string{"x@contoso.com", "y@contoso.com"},
+				setHeaders:    [][2]string{{"X-Rule", "b"}},
+				subjectPrefix: "[A] [B] ",
+				importance:    "high",
+			},
+		},
+		{
+			"later redirect wins",
+			"[a]\nRedirect = x@contoso.com\n[b]\nRedirect = y@contoso.com, z@contoso.com\n",
+			&ruleOutcome{matched: []string{"a", "b"}, redirect: []string{"y@contoso.com", "z@contoso.com"}},
+		},
+		{
+			"stop",
+			"[a]\nAddRecipient = x@contoso.com\nStop = true\n[b]\nAction = reject\n",
+			&ruleOutcome{matched: []string{"a"}, addRecipients: []string{"x@contoso.com"}},
+		},
+		{
+			"reject ends evaluation",
+			"[a]\nAction = reject\nMessage = No reports\n[b]\nAction = discard\n",
+			&ruleOutcome{matched: []string{"a"}, reject: "No reports"},
+		},
+		{
+			"discard ends evaluation",
+			"[a]\nSender = @contoso.com\nAction = discard\n[b]\nAction = reject\n",
+			&ruleOutcome{matched: []string{"a"}, discard: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := loadTestRules(t, tt.rules); err != nil {
+				t.Fatal(err)
+			}
+			if got := evaluateRules(trans, header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("evaluateRules = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixSubject(t *testing.T) {
+	tests := []struct {
+		subject, prefix, want string
+	}{
+		{"Report", "[Scan] ", "[Scan] Report"},
+		{"[Scan] Report", "[Scan] ", "[Scan] Report"},
+		{"Report", "", "Report"},
+		{"", "[Scan] ", "[Scan] "},
+	}
+	for _, tt := range tests {
+		if got := prefixSubject(tt.subject, tt.prefix); got != tt.want {
+			t.Errorf("prefixSubject(%q, %q) = %q, want %q", tt.subject, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// --- Malware Scanning ---
+//
+// With [Scanner] Address set, every message is streamed to a clamd daemon
+// with the INSTREAM command before it is delivered:
+//
+//	[Scanner]
+//	Address = 127.0.0.1:3310      ; or unix:/run/clamav/clamd.ctl
+//	Mode = message                ; or attachments
+//	Action = reject               ; or quarantine
+//	FailOpen = false
+//	Timeout = 30s
+//
+// Mail received over SMTP is scanned at the end of DATA, so infected
+// messages can be refused while the client is connected; mail from the
+// spool or sendmail is scanned in processEmail. FailOpen decides whether
+// a message is delivered unscanned when clamd cannot be reached.
+
+// ScannerConfig is the parsed [Scanner] section.
+type ScannerConfig struct {
+	Address  string // host:port, or unix:<path> or an absolute path for a Unix socket
+	Mode     string // "message" or "attachments"
+	Action   string // "reject" or "quarantine"
+	FailOpen bool
+	Timeout  time.Duration
+}
+
+func loadScannerConfig(sec *ini.Section) ScannerConfig {
+	return ScannerConfig{
+		Address:  sec.Key("Address").String(),
+		Mode:     strings.ToLower(sec.Key("Mode").In("message", []string{"message", "attachments"})),
+		Action:   strings.ToLower(sec.Key("Action").In(actionReject, []string{actionReject, actionQuarantine})),
+		FailOpen: sec.Key("FailOpen").MustBool(false),
+		Timeout:  sec.Key("Timeout").MustDuration(30 * time.Second),
+	}
+}
+
+// clamdChunkSize is the size of the chunks sent with INSTREAM. clamd's
+// StreamMaxLength limits the total, not the chunks.
+const clamdChunkSize = 64 * 1024
+
+var errScannerUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Malware scanner unavailable, try again later",
+}
+
+// scanTransaction scans the message of trans unless that was done already.
+// It returns the SMTP error the message must be refused with, or nil; an
+// infected message with Action = quarantine is marked for quarantine
+// instead.
+func scanTransaction(trans *EmailTransaction) error {
+	sc := &config.Scanner
+	if sc.Address == "" || trans.scanned || !trans.hasData() {
+		return nil
+	}
+
+	start := time.Now()
+	name, virus, err := scanData(trans)
+	if err != nil {
+		if sc.FailOpen {
+			logger.Printf("Scanner: %v; delivering message from %s unscanned (fail-open)", err, trans.from)
+			trans.scanned = true
+			return nil
+		}
+		logger.Printf("Scanner: %v; deferring message from %s (fail-closed)", err, trans.from)
+		return errScannerUnavailable
+	}
+	trans.scanned = true
+
+	if virus == "" {
+		debugLog("Scanner: message from %s is clean (%v)", trans.from, time.Since(start))
+		return nil
+	}
+	reason := "malware " + virus + " found"
+	if name != "" {
+		reason += " in " + name
+	}
+	if sc.Action == actionQuarantine {
+		logger.Printf("Scanner: %s in message from %s; quarantining", reason, trans.from)
+		trans.quarantine = reason
+		return nil
+	}
+	logger.Printf("Scanner: %s in message from %s; rejecting", reason, trans.from)
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected: " + reason,
+	}
+}
+
+// scanData sends the message, or each of its parts other than text, to
+// clamd. It returns the signature found and, in attachment mode, the name
+// of the infected part.
+func scanData(trans *EmailTransaction) (name, virus string, err error) {
+	f, err := trans.openData()
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if config.Scanner.Mode != "attachments" {
+		virus, err = clamdScan(f)
+		return "", virus, err
+	}
+
+	msg, err := mail.CreateReader(bufio.NewReader(f))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse message for scanning: %w", err)
+	}
+	// Inline parts are scanned too: images are delivered with the body,
+	// and a client may show any part without a filename
+	for n := 1; ; n++ {
+		part, err := msg.NextPart()
+		if err == io.EOF {
+			return "", "", nil
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read MIME part: %w", err)
+		}
+		var name string
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			if strings.HasPrefix(contentType, "text/") {
+				continue // The body
+			}
+			name = fmt.Sprintf("inline part %d (%s)", n, contentType)
+		case *mail.AttachmentHeader:
+			name, _ = h.Filename()
+			if name == "" {
+				contentType, _, _ := h.ContentType()
+				name = fmt.Sprintf("attachment %d (%s)", n, contentType)
+			}
+		}
+		if virus, err = clamdScan(part.Body); err != nil || virus != "" {
+			return name, virus, err
+		}
+	}
+}
+
+// clamdScan streams r to clamd and returns the signature found, or "" when
+// the content is clean.
+func clamdScan(r io.Reader) (string, error) {
+	sc := &config.Scanner
+	network, address := "tcp", sc.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, address, sc.Timeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd at %s: %w", sc.Address, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(sc.Timeout))
+
+	w := bufio.NewWriter(conn)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := w.Write(size[:]); err != nil {
+				return "", fmt.Errorf("failed to send to clamd: %w", err)
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return "", fmt.Errorf("failed to send to clamd: %w", err)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := w.Write(size[:]); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("no reply from clamd: %w", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply interprets "stream: OK", "stream: <name> FOUND" and
+// "... ERROR" replies.
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd error: %s", reply)
+	}
+}
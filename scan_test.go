@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM requests, finding "EICAR" in any stream, and
+// returns its address.
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			var stream bytes.Buffer
+			if _, err := r.ReadString(0); err == nil {
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil || size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						break
+					}
+				}
+			}
+			if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+				io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+			} else {
+				io.WriteString(conn, "stream: OK\x00")
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestScanDataAttachmentsMode(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.TempDirectory = t.TempDir()
+	config.Scanner = ScannerConfig{Address: fakeClamd(t), Mode: "attachments", Timeout: 5 * time.Second}
+
+	scan := func(t *testing.T, raw string) (string, string) {
+		t.Helper()
+		trans := &EmailTransaction{}
+		if err := trans.storeData(strings.NewReader(strings.ReplaceAll(raw, "\n", "\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+		defer trans.discardData()
+		name, virus, err := scanData(trans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name, virus
+	}
+
+	t.Run("inline image", func(t *testing.T) {
+		// An inline part without a filename is no attachment, but is
+		// delivered all the same
+		name, virus := scan(t, `Content-Type: multipart/related; boundary=b
+
+--b
+Content-Type: text/plain
+
+Mentions EICAR in the text, which is not scanned on its own
+--b
+Content-Type: image/gif
+Content-Disposition: inline
+Content-ID: <logo>
+
+EICAR
+--b--
+`)
+		if virus != "Eicar-Test-Signature" || name != "inline part 2 (image/gif)" {
+			t.Errorf("got %q in %q", virus, name)
+		}
+	})
+
+	t.Run("attachment", func(t *testing.T) {
+		name, virus := scan(t, `Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: text/plain
+
+Hello
+--b
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename=run.exe
+
+EICAR
+--b--
+`)
+		if virus != "Eicar-Test-Signature" || name != "run.exe" {
+			t.Errorf("got %q in %q", virus, name)
+		}
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		if name, virus := scan(t, "Content-Type: text/plain\n\nEICAR is only mentioned\n"); virus != "" {
+			t.Errorf("text body scanned: %q in %q", virus, name)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"github.com/emersion/go-smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Sender Validation ---
+//
+// With [SenderValidation] Enabled, Session.Mail looks the sender up through
+// GET /users/{address} before accepting the transaction, so a bad sender is
+// refused while the client is still connected. Session.Data checks the
+// header From the message will be sent as in the same way. Results are
+// cached: existing mailboxes for PositiveTTL, unknown ones for NegativeTTL.
+
+var (
+	errUnknownSender = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 0},
+		Message:      "Sender address rejected: mailbox unknown",
+	}
+	errSenderCheckFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "Sender address could not be verified, try again later",
+	}
+)
+
+type senderCacheEntry struct {
+	valid   bool
+	expires time.Time
+}
+
+var (
+	senderCacheMu sync.Mutex
+	senderCache   = make(map[string]senderCacheEntry)
+)
+
+// validateSender returns nil when the sender is a mail-enabled user, and an
+// SMTP error suitable for the MAIL FROM response otherwise.
+func validateSender(address string) error {
+	key := strings.ToLower(address)
+
+	senderCacheMu.Lock()
+	entry, ok := senderCache[key]
+	senderCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		debugLog("Sender %s found in cache (valid=%v)", address, entry.valid)
+		if entry.valid {
+			return nil
+		}
+		return errUnknownSender
+	}
+
+	valid, err := lookupSender(address)
+	if err != nil {
+		// Lookup failures are not cached; the next MAIL FROM tries again.
+		logger.Printf("Sender validation for %s failed: %v", address, err)
+		return errSenderCheckFailed
+	}
+
+	ttl := config.SenderPositiveTTL
+	if !valid {
+		ttl = config.SenderNegativeTTL
+	}
+	senderCacheMu.Lock()
+	senderCache[key] = senderCacheEntry{valid: valid, expires: time.Now().Add(ttl)}
+	senderCacheMu.Unlock()
+
+	logger.Printf("Sender %s validated (valid=%v, cached for %v)", address, valid, ttl)
+	if !valid {
+		return errUnknownSender
+	}
+	return nil
+}
+
+// lookupSender reports whether address is a user with a mailbox, using the
+// app registration that would send the sender's mail.
+func lookupSender(address string) (bool, error) {
+	creds := config.graphCredentials()
+	if len(config.Tenants) > 0 {
+		tenant := tenantForSender(address)
+		if tenant == nil {
+			return false, nil
+		}
+		creds = tenant.Credentials
+	}
+
+	token, err := getAccessToken(creds)
+	if err != nil {
+		return false, err
+	}
+	user, err := lookupUser(token, address)
+	if errors.Is(err, errUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.Mail != "", nil
+}
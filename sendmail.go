@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// --- sendmail Compatibility Mode ---
+//
+// Invoked as "smtpservice sendmail [flags] [recipient ...]" or through a
+// symlink named sendmail, the binary reads an RFC 5322 message from stdin and
+// either delivers it directly or drops it into the spool of a running relay.
+
+// Exit codes from sysexits.h, which sendmail callers expect.
+const (
+	exitOK       = 0
+	exitUsage    = 64
+	exitDataErr  = 65
+	exitSoftware = 70
+	exitTempFail = 75
+)
+
+type sendmailOptions struct {
+	from             string
+	fullName         string
+	readRecipients   bool // -t
+	ignoreDots       bool // -i, -oi
+	recipients       []string
+	deliveryOverride string
+}
+
+// parseSendmailArgs understands the subset of sendmail flags used by scripts
+// and cron. Unknown -o and -b options are accepted and ignored.
+func parseSendmailArgs(args []string) (*sendmailOptions, error) {
+	opts := &sendmailOptions{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			opts.recipients = append(opts.recipients, arg)
+			continue
+		}
+		if arg == "--" {
+			opts.recipients = append(opts.recipients, args[i+1:]...)
+			break
+		}
+
+		// Options that take a value accept it attached (-fuser) or separate (-f user).
+		value := func() (string, error) {
+			if len(arg) > 2 {
+				return arg[2:], nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires an argument", arg)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch {
+		case arg == "-t":
+			opts.readRecipients = true
+		case arg == "-i" || arg == "-oi":
+			opts.ignoreDots = true
+		case strings.HasPrefix(arg, "-f") || strings.HasPrefix(arg, "-r"):
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			opts.from = strings.Trim(v, "<>")
+		case strings.HasPrefix(arg, "-F"):
+			v, err := value()
+			if err != nil {
+				return nil, err
+			}
+			opts.fullName = v
+		case arg == "--spool":
+			opts.deliveryOverride = "spool"
+		case arg == "--direct":
+			opts.deliveryOverride = "direct"
+		case strings.HasPrefix(arg, "-o"), strings.HasPrefix(arg, "-b"), arg == "-v", arg == "-m", arg == "-n":
+			debugLog("sendmail: ignoring option %s", arg)
+		default:
+			return nil, fmt.Errorf("unsupported option %s", arg)
+		}
+	}
+	return opts, nil
+}
+
+// readSendmailInput reads the message from r. Unless dots are ignored, a line
+// containing a single "." ends the message, as with classic sendmail.
+func readSendmailInput(r io.Reader, ignoreDots bool) ([]byte, error) {
+	if ignoreDots {
+		return io.ReadAll(r)
+	}
+	var buf bytes.Buffer
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "." {
+			break
+		}
+		buf.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// runSendmail implements sendmail mode and returns the process exit code.
+func runSendmail(args []string) int {
+	opts, err := parseSendmailArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exitUsage
+	}
+
+	input, err := readSendmailInput(os.Stdin, opts.ignoreDots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: failed to read message: %v\n", err)
+		return exitDataErr
+	}
+
+	br := bufio.NewReader(bytes.NewReader(input))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: invalid message header: %v\n", err)
+		return exitDataErr
+	}
+	header := mail.Header{Header: message.Header{Header: h}}
+
+	recipients := opts.recipients
+	if opts.readRecipients {
+		for _, field := range []string{"To", "Cc", "Bcc"} {
+			addrs, err := header.AddressList(field)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "sendmail: invalid %s header: %v\n", field, err)
+				return exitDataErr
+			}
+			for _, addr := range addrs {
+				recipients = append(recipients, addr.Address)
+			}
+		}
+		// Bcc recipients must not see each other.
+		header.Del("Bcc")
+	}
+	if len(recipients) == 0 {
+		fmt.Fprintln(os.Stderr, "sendmail: no recipients given")
+		return exitUsage
+	}
+
+	sender := opts.from
+	if from, err := header.AddressList("From"); err == nil && len(from) > 0 {
+		if sender == "" {
+			sender = from[0].Address
+		}
+	} else if sender != "" {
+		header.SetAddressList("From", []*mail.Address{{Name: opts.fullName, Address: sender}})
+	}
+	if sender == "" {
+		fmt.Fprintln(os.Stderr, "sendmail: no sender; use -f or add a From header")
+		return exitUsage
+	}
+	if !header.Has("Date") {
+		header.SetDate(time.Now())
+	}
+
+	// Re-serialize the adjusted header in front of the untouched body.
+	var raw bytes.Buffer
+	if err := textproto.WriteHeader(&raw, header.Header.Header); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: failed to prepare message: %v\n", err)
+		return exitSoftware
+	}
+	if _, err := io.Copy(&raw, br); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: failed to prepare message: %v\n", err)
+		return exitSoftware
+	}
+
+	delivery := config.SendmailDelivery
+	if opts.deliveryOverride != "" {
+		delivery = opts.deliveryOverride
+	}
+	logger.Printf("sendmail: message from %s to %v (%d bytes, delivery %s)", sender, recipients, raw.Len(), delivery)
+
+	// The operating system authenticated the local user that submitted the
+	// message, which stands in for an SMTP AUTH user
+	authUser := ""
+	if u, err := user.Current(); err == nil {
+		authUser = u.Username
+	}
+
+	if delivery == "spool" {
+		id, err := spoolEntryMessage(&spoolEntry{From: sender, To: recipients, AuthUser: authUser}, raw.Bytes())
+		if err != nil {
+			logger.Printf("sendmail: %v", err)
+			fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+			return exitTempFail
+		}
+		logger.Printf("sendmail: queued as %s", id)
+		return exitOK
+	}
+
+	trans := &EmailTransaction{from: sender, returnPath: sender, authUser: authUser}
+	defer trans.discardData()
+	for _, rcpt := range recipients {
+		trans.addRecipient(rcpt)
+	}
+	if _, err := processEmailContent(bytes.NewReader(raw.Bytes()), trans); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return exitDataErr
+	}
+	if _, err := processEmail(trans); err != nil {
+		// A caller retrying would send the copies that were delivered
+		// again, so the rest of a partly delivered message is queued
+		if _, delivered := partialDelivery(err); len(delivered) > 0 {
+			id, serr := spoolEntryMessage(&spoolEntry{From: sender, To: recipients, AuthUser: authUser, Delivered: delivered}, raw.Bytes())
+			if serr == nil {
+				logger.Printf("sendmail: partly delivered, rest queued as %s: %v", id, err)
+				fmt.Fprintf(os.Stderr, "sendmail: delivery to some recipients failed, queued for retry as %s: %v\n", id, err)
+				return exitOK
+			}
+			logger.Printf("sendmail: %v", serr)
+		}
+		fmt.Fprintf(os.Stderr, "sendmail: delivery failed: %v\n", err)
+		return exitTempFail
+	}
+	return exitOK
+}
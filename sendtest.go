@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- send-test Command ---
+
+// stringList is a repeatable flag that also accepts comma-separated values.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// sendTest builds a test message and delivers it either through the local
+// processing pipeline or, with --via-smtp, through a running relay.
+func sendTest(args []string) error {
+	fs := flag.NewFlagSet("send-test", flag.ContinueOnError)
+	from := fs.String("from", "", "sender mailbox (required)")
+	var to, attach stringList
+	fs.Var(&to, "to", "recipient address; repeat or comma-separate for several (required)")
+	subject := fs.String("subject", "Relay test message", "message subject")
+	body := fs.String("body", "", "plain-text body (default: a short description of the test)")
+	fs.Var(&attach, "attach", "file to attach; may be repeated")
+	viaSMTP := fs.String("via-smtp", "", "submit to a running relay at host:port instead of sending directly; the relay delivers after QUIT, so the Graph request-id is only in its log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" || len(to) == 0 {
+		fs.Usage()
+		return fmt.Errorf("--from and --to are required")
+	}
+	if *body == "" {
+		host, _ := os.Hostname()
+		*body = fmt.Sprintf("This is a test message sent by send-test from %s at %s.", host, time.Now().Format(time.RFC1123Z))
+	}
+
+	raw, err := buildTestMessage(*from, to, *subject, *body, attach)
+	if err != nil {
+		return fmt.Errorf("failed to build message: %w", err)
+	}
+
+	start := time.Now()
+	if *viaSMTP != "" {
+		fmt.Printf("Submitting %d bytes to relay at %s...\n", len(raw), *viaSMTP)
+		if err := submitSMTP(*viaSMTP, *from, to, raw); err != nil {
+			return err
+		}
+		fmt.Printf("Accepted by relay in %v\n", time.Since(start))
+		// The relay answers DATA before it delivers, so its reply cannot
+		// carry the request-id
+		fmt.Printf("The relay delivers after QUIT; look for the subject %q in its log for the Graph request-id.\n", *subject)
+		return nil
+	}
+
+	trans := &EmailTransaction{from: *from, returnPath: *from}
+	defer trans.discardData()
+	for _, rcpt := range to {
+		trans.addRecipient(rcpt)
+	}
+	if _, err := processEmailContent(bytes.NewReader(raw), trans); err != nil {
+		return err
+	}
+
+	result, err := processEmail(trans)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Delivered via %s in %v (request-id %s, %d attempt(s), %v in transport)\n",
+		result.Transport, time.Since(start), result.RequestID, result.Attempts, result.Duration)
+	return nil
+}
+
+// submitSMTP hands a message to an SMTP server without requiring STARTTLS,
+// which the relay does not offer.
+func submitSMTP(addr, from string, to []string, raw []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildTestMessage renders a multipart message with a text body and the
+// given files as attachments.
+func buildTestMessage(from string, to []string, subject, body string, attachments []string) ([]byte, error) {
+	var h mail.Header
+	h.SetDate(time.Now())
+	h.SetSubject(subject)
+	h.SetAddressList("From", []*mail.Address{{Address: from}})
+	var toAddrs []*mail.Address
+	for _, addr := range to {
+		toAddrs = append(toAddrs, &mail.Address{Address: addr})
+	}
+	h.SetAddressList("To", toAddrs)
+	if err := h.GenerateMessageID(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mw, err := mail.CreateWriter(&buf, h)
+	if err != nil {
+		return nil, err
+	}
+
+	var th mail.InlineHeader
+	th.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	w, err := mw.CreateSingleInline(th)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	for _, path := range attachments {
+		content, err := os.ReadFile(resolveLaunchPath(path))
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		var ah mail.AttachmentHeader
+		ah.SetContentType(contentType, nil)
+		ah.SetFilename(filepath.Base(path))
+		w, err := mw.CreateAttachment(ah)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"net"
+	"sync"
+	"time"
+)
+
+// --- SMTP Server Setup ---
+
+// newSMTPServer creates the SMTP server with the limits from [Server].
+// MaxMessageBytes also makes go-smtp advertise SIZE and reject larger
+// messages with 552, both at MAIL FROM and during DATA. DSN is advertised
+// when there is a postmaster mailbox to send reports from.
+func newSMTPServer() *smtp.Server {
+	server := smtp.NewServer(&Backend{})
+	server.Addr = fmt.Sprintf("%s:%s", config.Host, config.Port)
+	server.AllowInsecureAuth = true
+	server.MaxMessageBytes = config.MaxMessageBytes
+	server.MaxRecipients = config.MaxRecipients
+	server.EnableDSN = config.Postmaster != ""
+	server.ReadTimeout = config.ReadTimeout
+	server.WriteTimeout = config.WriteTimeout
+	server.ErrorLog = logger
+	return server
+}
+
+// serveSMTP listens on the server address and serves connections within
+// the configured connection limits.
+func serveSMTP(server *smtp.Server) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	logger.Printf("SMTP limits: %d bytes per message, %d recipients, %d connections (%d per IP), timeouts read %v / write %v",
+		server.MaxMessageBytes, server.MaxRecipients, config.MaxConnections, config.MaxConnectionsPerIP, server.ReadTimeout, server.WriteTimeout)
+	return server.Serve(&limitListener{
+		Listener: l,
+		max:      config.MaxConnections,
+		maxPerIP: config.MaxConnectionsPerIP,
+		perIP:    make(map[string]int),
+	})
+}
+
+// limitListener caps concurrent connections in total and per client IP.
+// Connections over a limit get a 421 reply and are closed. A limit of 0
+// means no limit.
+type limitListener struct {
+	net.Listener
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := c.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		l.mu.Lock()
+		var reason string
+		switch {
+		case l.max > 0 && l.total >= l.max:
+			reason = fmt.Sprintf("%d connections open", l.total)
+		case l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP:
+			reason = fmt.Sprintf("%d connections open from %s", l.perIP[ip], ip)
+		default:
+			l.total++
+			l.perIP[ip]++
+		}
+		l.mu.Unlock()
+
+		if reason != "" {
+			logger.Printf("Refusing connection from %s: %s", c.RemoteAddr(), reason)
+			_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, _ = c.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+			_ = c.Close()
+			continue
+		}
+		return &limitConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *limitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// limitConn releases its slot in the listener when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -4,7 +4,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/emersion/go-smtp"
 )
 
 func isWindowsService() bool {
@@ -21,12 +20,10 @@ func removeService(serviceName string) {
 }
 
 func runApp() error {
-	be := &Backend{}
-	server := smtp.NewServer(be)
-	server.Addr = fmt.Sprintf("%s:%s", config.Host, config.Port)
-	server.AllowInsecureAuth = true
+	server := newSMTPServer()
 	logger.Printf("Starting SMTP server on %s...", server.Addr)
-	return server.ListenAndServe()
+	startSpoolWorker(nil)
+	return serveSMTP(server)
 }
 
 func runWindowsService() error {
@@ -3,8 +3,6 @@
 package main
 
 import (
-	"fmt"
-	"github.com/emersion/go-smtp"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
@@ -53,17 +51,15 @@ func overrideLoggerForService() {
 }
 
 func runAppWithStop(stopCh chan struct{}) error {
-	be := &Backend{}
-	server := smtp.NewServer(be)
-	server.Addr = fmt.Sprintf("%s:%s", config.Host, config.Port)
-	server.AllowInsecureAuth = true
+	server := newSMTPServer()
 
 	errCh := make(chan error, 1)
+	startSpoolWorker(stopCh)
 
 	// Start the SMTP server in a goroutine.
 	go func() {
 		logger.Printf("Starting the SMTP server on %s...", server.Addr)
-		errCh <- server.ListenAndServe() // Blocks until an error occurs or stop signal is received.
+		errCh <- serveSMTP(server) // Blocks until an error occurs or stop signal is received.
 	}()
 
 	logger.Println("SMTP server is starting...")
@@ -270,10 +266,8 @@ func removeService(serviceName string) {
 }
 
 func runApp() error {
-	be := &Backend{}
-	server := smtp.NewServer(be)
-	server.Addr = fmt.Sprintf("%s:%s", config.Host, config.Port)
-	server.AllowInsecureAuth = true
+	server := newSMTPServer()
 	logger.Printf("Starting SMTP server on %s...", server.Addr)
-	return server.ListenAndServe()
+	startSpoolWorker(nil)
+	return serveSMTP(server)
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Message Spool ---
+//
+// The spool is a directory of messages waiting for delivery by the running
+// relay. Each message is stored as <id>.eml with its envelope in <id>.json.
+// The JSON file is written last, so a message is only picked up once it is
+// complete. The spool worker and the queue command change a message only
+// while holding the lock on its <id>.lock file.
+
+// spoolEntry is the envelope and delivery state of a spooled message.
+type spoolEntry struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	ClientIP    string    `json:"clientIP,omitempty"` // SMTP client, for the recipient policy and rules
+	AuthUser    string    `json:"authUser,omitempty"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	Failed      bool      `json:"failed,omitempty"`   // Gave up after MaxAttempts
+	Released    bool      `json:"released,omitempty"` // Released from the quarantine
+	Held        bool      `json:"held,omitempty"`     // Not delivered until released with queue release
+
+	DSN           *messageDSN `json:"dsn,omitempty"`           // DSN parameters given over SMTP; see dsn.go
+	DelayReported bool        `json:"delayReported,omitempty"` // A NOTIFY=DELAY report was sent
+
+	Delivered []string `json:"delivered,omitempty"` // Recipients an earlier attempt reached; see chunk.go
+}
+
+func spoolPath(id, ext string) string {
+	return filepath.Join(config.SpoolDirectory, id+ext)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// spoolEntryMessage stores a message with the envelope of entry, which is
+// given an ID and is due immediately.
+func spoolEntryMessage(entry *spoolEntry, raw []byte) (string, error) {
+	if err := os.MkdirAll(config.SpoolDirectory, 0700); err != nil {
+		return "", fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	entry.ID = newSpoolID()
+	entry.Created = time.Now()
+	entry.NextAttempt = time.Now()
+	if err := writeFileAtomic(spoolPath(entry.ID, ".eml"), raw); err != nil {
+		return "", fmt.Errorf("failed to write spooled message: %w", err)
+	}
+	if err := saveSpoolEntry(entry); err != nil {
+		_ = os.Remove(spoolPath(entry.ID, ".eml"))
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+// spoolTransaction moves a message received over SMTP whose first delivery
+// attempt failed temporarily to the spool, to be retried.
+func spoolTransaction(trans *EmailTransaction, cause error) (*spoolEntry, error) {
+	if err := os.MkdirAll(config.SpoolDirectory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	entry := &spoolEntry{
+		ID:          newSpoolID(),
+		From:        trans.returnPath,
+		To:          trans.to,
+		AuthUser:    trans.authUser,
+		Created:     time.Now(),
+		Attempts:    1,
+		LastError:   cause.Error(),
+		NextAttempt: time.Now().Add(spoolBackoff(1)),
+		Delivered:   trans.delivered,
+
+		// A delay is reported, if requested, for the failed first attempt
+		DelayReported: true,
+	}
+	if trans.clientIP != nil {
+		entry.ClientIP = trans.clientIP.String()
+	}
+	if !trans.dsn.empty() {
+		dsn := trans.dsn
+		entry.DSN = &dsn
+	}
+	if err := copyDataTo(trans, spoolPath(entry.ID, ".eml")); err != nil {
+		return nil, fmt.Errorf("failed to write spooled message: %w", err)
+	}
+	if err := saveSpoolEntry(entry); err != nil {
+		_ = os.Remove(spoolPath(entry.ID, ".eml"))
+		return nil, err
+	}
+	return entry, nil
+}
+
+func newSpoolID() string {
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405"), uuid.New().String()[:8])
+}
+
+// spoolBackoff is the delay after the given number of failed attempts: 1m,
+// 2m, 4m, ... capped at one hour.
+func spoolBackoff(attempts int) time.Duration {
+	backoff := time.Minute << (attempts - 1)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+	return backoff
+}
+
+func saveSpoolEntry(entry *spoolEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(spoolPath(entry.ID, ".json"), data); err != nil {
+		return fmt.Errorf("failed to write spool envelope: %w", err)
+	}
+	return nil
+}
+
+func loadSpoolEntry(id string) (*spoolEntry, error) {
+	data, err := os.ReadFile(spoolPath(id, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid spool envelope %s: %w", id, err)
+	}
+	return &entry, nil
+}
+
+// listSpool returns all complete spool entries, oldest first.
+func listSpool() ([]*spoolEntry, error) {
+	files, err := filepath.Glob(filepath.Join(config.SpoolDirectory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*spoolEntry
+	for _, f := range files {
+		entry, err := loadSpoolEntry(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			logger.Printf("Skipping spool entry %s: %v", f, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries, nil
+}
+
+// lockSpoolEntry waits for the lock of a spooled message, which keeps the
+// spool worker and the queue command from overwriting each other's changes.
+func lockSpoolEntry(id string) (unlock func(), err error) {
+	f, err := os.OpenFile(spoolPath(id, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+		// A process still waiting for the lock finds the message gone
+		if _, err := os.Stat(spoolPath(id, ".json")); os.IsNotExist(err) {
+			_ = os.Remove(spoolPath(id, ".lock"))
+		}
+	}, nil
+}
+
+// withSpoolEntry calls fn with the current envelope of a spooled message
+// while holding its lock. The error of a missing message satisfies
+// os.IsNotExist.
+func withSpoolEntry(id string, fn func(*spoolEntry) error) error {
+	unlock, err := lockSpoolEntry(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entry, err := loadSpoolEntry(id)
+	if err != nil {
+		return err
+	}
+	return fn(entry)
+}
+
+func removeSpoolEntry(id string) error {
+	if err := os.Remove(spoolPath(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(spoolPath(id, ".eml")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// startSpoolWorker periodically delivers spooled messages until stop is
+// closed. A nil stop channel runs the worker for the life of the process.
+func startSpoolWorker(stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(config.SpoolPollInterval)
+		defer ticker.Stop()
+
+		logger.Printf("Spool worker watching %s every %v", config.SpoolDirectory, config.SpoolPollInterval)
+		for {
+			deliverSpool()
+			expireQuarantine()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// deliverSpool attempts delivery of every spooled message that is due.
+func deliverSpool() {
+	entries, err := listSpool()
+	if err != nil {
+		logger.Printf("Failed to read spool: %v", err)
+		return
+	}
+
+	now := time.Now()
+	due := func(entry *spoolEntry) bool {
+		return !entry.Failed && !entry.Held && !now.Before(entry.NextAttempt)
+	}
+	for _, entry := range entries {
+		if !due(entry) {
+			continue
+		}
+		// The queue command may have changed or deleted the message since
+		// it was listed
+		err := withSpoolEntry(entry.ID, func(entry *spoolEntry) error {
+			if due(entry) {
+				deliverSpoolEntry(entry)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("[spool %s] %v", entry.ID, err)
+		}
+	}
+}
+
+func deliverSpoolEntry(entry *spoolEntry) {
+	logger.Printf("[spool %s] Delivering message from %s (attempt %d)", entry.ID, entry.From, entry.Attempts+1)
+
+	result, err := processSpoolEntry(entry)
+	if err == nil {
+		logger.Printf("[spool %s] Delivered via %s (request-id %s)", entry.ID, result.Transport, result.RequestID)
+		if result.Transport != "quarantine" && result.Transport != "discard" {
+			sendSuccessDSN(entry.From, entry.To, spoolPath(entry.ID, ".eml"), entry.DSN)
+		}
+		if err := removeSpoolEntry(entry.ID); err != nil {
+			logger.Printf("[spool %s] Failed to remove delivered message: %v", entry.ID, err)
+		}
+		return
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	recipients := entry.To
+	if failed, delivered := partialDelivery(err); failed != nil {
+		recipients = failed
+		entry.Delivered = append(entry.Delivered, delivered...)
+	}
+	if !isTemporary(err) {
+		entry.Failed = true
+		logger.Printf("[spool %s] Giving up: %v", entry.ID, err)
+		sendNDR(entry.From, recipients, spoolPath(entry.ID, ".eml"), entry.DSN, err)
+	} else if entry.Attempts >= config.SpoolMaxAttempts {
+		entry.Failed = true
+		logger.Printf("[spool %s] Giving up after %d attempts: %v", entry.ID, entry.Attempts, err)
+		sendNDR(entry.From, recipients, spoolPath(entry.ID, ".eml"), entry.DSN, err)
+	} else {
+		entry.NextAttempt = time.Now().Add(spoolBackoff(entry.Attempts))
+		logger.Printf("[spool %s] Delivery failed, retrying at %s: %v", entry.ID, entry.NextAttempt.Format(time.RFC3339), err)
+		if !entry.DelayReported {
+			sendDelayDSN(entry.From, recipients, spoolPath(entry.ID, ".eml"), entry.DSN, err)
+			entry.DelayReported = true
+		}
+	}
+	if err := saveSpoolEntry(entry); err != nil {
+		logger.Printf("[spool %s] %v", entry.ID, err)
+	}
+}
+
+func processSpoolEntry(entry *spoolEntry) (*DeliveryResult, error) {
+	f, err := os.Open(spoolPath(entry.ID, ".eml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spooled message: %w", err)
+	}
+	defer f.Close()
+
+	// A released message was scanned and held already; an administrator
+	// decided it may go
+	trans := &EmailTransaction{from: entry.From, returnPath: entry.From, released: entry.Released, scanned: entry.Released, delivered: entry.Delivered}
+	trans.clientIP = net.ParseIP(entry.ClientIP) // nil for locally submitted mail
+	trans.authUser = entry.AuthUser
+	defer trans.discardData()
+	for _, rcpt := range entry.To {
+		trans.addRecipient(rcpt)
+	}
+	if _, err := processEmailContent(f, trans); err != nil {
+		return nil, fmt.Errorf("failed to parse spooled message: %w", err)
+	}
+	return processEmail(trans)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- Streaming Message Handling ---
+//
+// Message data never has to fit in memory as a whole. DATA is written to a
+// temporary file in [Server] TempDirectory, attachments are decoded into
+// temporary files while the message is parsed, and request bodies that
+// carry attachments are written to disk with the base64 encoding done on
+// the fly. Only the text and HTML bodies are held in memory, within the
+// [Server] MemoryBudget shared by all messages in flight.
+
+// createTempFile creates a temporary file in the configured directory.
+func createTempFile(pattern string) (*os.File, error) {
+	if config.TempDirectory != "" {
+		if err := os.MkdirAll(config.TempDirectory, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return os.CreateTemp(config.TempDirectory, pattern)
+}
+
+// createTempDir creates a temporary directory in the configured directory.
+func createTempDir(pattern string) (string, error) {
+	if config.TempDirectory != "" {
+		if err := os.MkdirAll(config.TempDirectory, 0700); err != nil {
+			return "", err
+		}
+	}
+	return os.MkdirTemp(config.TempDirectory, pattern)
+}
+
+// savePart decodes a MIME part into the file part-<n> in dir.
+func savePart(dir string, n int, r io.Reader) (string, int64, error) {
+	path := filepath.Join(dir, fmt.Sprintf("part-%d", n))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read MIME part: %w", err)
+	}
+	return path, size, nil
+}
+
+// storeData writes the raw message to a temporary file, replacing any data
+// stored before.
+func (e *EmailTransaction) storeData(r io.Reader) error {
+	e.discardData()
+	f, err := createTempFile("data-*.eml")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	e.dataPath, e.dataSize = f.Name(), n
+	return nil
+}
+
+// hasData reports whether a message has been stored for the transaction.
+func (e *EmailTransaction) hasData() bool {
+	return e.dataPath != ""
+}
+
+func (e *EmailTransaction) openData() (*os.File, error) {
+	return os.Open(e.dataPath)
+}
+
+// discardData removes the stored message, if any.
+func (e *EmailTransaction) discardData() {
+	if e.dataPath == "" {
+		return
+	}
+	if err := os.Remove(e.dataPath); err != nil && !os.IsNotExist(err) {
+		logger.Printf("Failed to remove temporary file %s: %v", e.dataPath, err)
+	}
+	e.dataPath, e.dataSize = "", 0
+}
+
+// memoryBudget limits the bytes of message content held in memory by all
+// messages being processed. A message reserves what it needs up front and
+// waits while others hold the budget, for at most memoryBudgetWait; then it
+// fails temporarily. A message that needs more than the whole budget fails
+// at once. A total of 0 or less means no limit.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	total int64
+	used  int64
+}
+
+func newMemoryBudget(total int64) *memoryBudget {
+	b := &memoryBudget{total: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+var messageMemory = newMemoryBudget(0)
+
+// memoryBudgetWait is how long a message waits for the memory budget.
+var memoryBudgetWait = 2 * time.Minute
+
+func (b *memoryBudget) acquire(n int64) error {
+	if b.total <= 0 {
+		return nil
+	}
+	if n > b.total {
+		return &DeliveryError{Err: fmt.Errorf("message needs %d bytes of memory, more than the budget of %d", n, b.total)}
+	}
+
+	// The timer wakes the waiters under the lock, so the wake-up cannot fall
+	// between the deadline check and Wait
+	deadline := time.Now().Add(memoryBudgetWait)
+	timer := time.AfterFunc(memoryBudgetWait, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.total {
+		if !time.Now().Before(deadline) {
+			return &DeliveryError{Err: fmt.Errorf("timed out after %v waiting for %d bytes of the memory budget", memoryBudgetWait, n), Temporary: true}
+		}
+		b.cond.Wait()
+	}
+	b.used += n
+	return nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b.total <= 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// writeJSONWithAttachments writes v as JSON, replacing the empty array
+// under key with one object per attachment. Each object holds the fields
+// from meta plus contentBytes, base64-encoded while the attachment is
+// copied from its file.
+func writeJSONWithAttachments(w io.Writer, v interface{}, key string, attachments []Attachment, meta func(Attachment) map[string]interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Inside JSON strings quotes are escaped, so the marker only matches
+	// the key itself.
+	marker := []byte(`"` + key + `":[]`)
+	i := bytes.Index(data, marker)
+	if i < 0 {
+		return fmt.Errorf("JSON document has no empty %q array", key)
+	}
+	if _, err := w.Write(data[:i+len(marker)-1]); err != nil {
+		return err
+	}
+
+	for n, a := range attachments {
+		fields, err := json.Marshal(meta(a))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			fields = append([]byte(","), fields...)
+		}
+		// Reopen the object to append contentBytes.
+		if _, err := w.Write(fields[:len(fields)-1]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, `,"contentBytes":"`); err != nil {
+			return err
+		}
+		if err := copyBase64(w, a); err != nil {
+			return fmt.Errorf("attachment %q: %w", a.Name, err)
+		}
+		if _, err := io.WriteString(w, `"}`); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(data[i+len(marker)-1:])
+	return err
+}
+
+func copyBase64(w io.Writer, a Attachment) error {
+	r, err := a.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writeRequestFile writes a JSON request body with attachments to a
+// temporary file and returns its path. The caller removes the file.
+func writeRequestFile(v interface{}, key string, attachments []Attachment, meta func(Attachment) map[string]interface{}) (string, error) {
+	f, err := createTempFile("request-*.json")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	err = writeJSONWithAttachments(f, v, key, attachments, meta)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetUnlimited(t *testing.T) {
+	b := newMemoryBudget(0)
+	if err := b.acquire(1 << 40); err != nil {
+		t.Fatalf("unlimited budget refused: %v", err)
+	}
+	b.release(1 << 40)
+}
+
+func TestMemoryBudgetOverBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+	err := b.acquire(101)
+	if err == nil {
+		t.Fatal("a message larger than the budget was let through")
+	}
+	if isTemporary(err) {
+		t.Errorf("over-budget error %v is temporary; waiting cannot help", err)
+	}
+	if b.used != 0 {
+		t.Errorf("used = %d after a refused acquire", b.used)
+	}
+}
+
+func TestMemoryBudgetWaitsForRelease(t *testing.T) {
+	b := newMemoryBudget(100)
+	if err := b.acquire(60); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- b.acquire(50) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquire did not wait for the budget: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.release(60)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire still waiting after release")
+	}
+	if b.used != 50 {
+		t.Errorf("used = %d, want 50", b.used)
+	}
+}
+
+func TestMemoryBudgetTimeout(t *testing.T) {
+	saved := memoryBudgetWait
+	t.Cleanup(func() { memoryBudgetWait = saved })
+	memoryBudgetWait = 50 * time.Millisecond
+
+	b := newMemoryBudget(100)
+	if err := b.acquire(60); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := b.acquire(50)
+	if err == nil {
+		t.Fatal("acquire succeeded while the budget was held")
+	}
+	if !isTemporary(err) {
+		t.Errorf("timeout error %v is not temporary; the message should be retried", err)
+	}
+	if waited := time.Since(start); waited < memoryBudgetWait {
+		t.Errorf("gave up after %v, before the wait of %v", waited, memoryBudgetWait)
+	}
+	if b.used != 60 {
+		t.Errorf("used = %d after a timed out acquire, want 60", b.used)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Multi-Tenant Routing ---
+//
+// A relay shared by several organizations can define one [Tenant.<name>]
+// section per Entra tenant:
+//
+//	[Tenant.fabrikam]
+//	TenantID = fabrikam.onmicrosoft.com
+//	ClientID = ...
+//	ClientSecret = ...
+//	Domains = fabrikam.com, fabrikam.de
+//
+// The sender's domain selects the tenant whose app registration sends the
+// message. Senders in no tenant's domains are rejected at MAIL FROM.
+
+// TenantConfig is an Entra tenant and the sender domains it serves.
+type TenantConfig struct {
+	Name        string
+	Credentials GraphCredentials
+	Domains     []string
+}
+
+var errNoTenant = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Sender domain is not served by this relay",
+}
+
+func loadTenantConfigs(cfg *ini.File) []TenantConfig {
+	var tenants []TenantConfig
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "Tenant.")
+		if !ok {
+			continue
+		}
+		var domains []string
+		for _, d := range sec.Key("Domains").Strings(",") {
+			domains = append(domains, strings.ToLower(d))
+		}
+		tenants = append(tenants, TenantConfig{
+			Name: name,
+			Credentials: GraphCredentials{
+				TenantID:     sec.Key("TenantID").String(),
+				ClientID:     sec.Key("ClientID").String(),
+				ClientSecret: sec.Key("ClientSecret").String(),
+				Scope:        sec.Key("Scope").MustString("https://graph.microsoft.com/.default"),
+			},
+			Domains: domains,
+		})
+	}
+	return tenants
+}
+
+// senderDomain returns the lower-cased domain part of an address.
+func senderDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(address[at+1:], "<> "))
+}
+
+// tenantForSender returns the tenant serving the sender's domain, or nil.
+func tenantForSender(address string) *TenantConfig {
+	domain := senderDomain(address)
+	if domain == "" {
+		return nil
+	}
+	for i := range config.Tenants {
+		for _, d := range config.Tenants[i].Domains {
+			if d == domain {
+				return &config.Tenants[i]
+			}
+		}
+	}
+	return nil
+}
+
+// tokenCache holds the access token of one app registration.
+type tokenCache struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var (
+	tokenCachesMu sync.Mutex
+	tokenCaches   = make(map[GraphCredentials]*tokenCache)
+)
+
+// tokenCacheFor returns the cache for an app registration, so every tenant
+// and failover target keeps its own token.
+func tokenCacheFor(creds GraphCredentials) *tokenCache {
+	tokenCachesMu.Lock()
+	defer tokenCachesMu.Unlock()
+	c, ok := tokenCaches[creds]
+	if !ok {
+		c = &tokenCache{}
+		tokenCaches[creds] = c
+	}
+	return c
+}
+
+func (c *tokenCache) get(creds GraphCredentials) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Refresh a few minutes early so a token never expires mid-request.
+	if c.token != "" && time.Now().Before(c.expires.Add(-5*time.Minute)) {
+		return c.token, nil
+	}
+
+	token, lifetime, err := requestAccessToken(creds)
+	if err != nil {
+		c.token = ""
+		return "", err
+	}
+	c.token = token
+	c.expires = time.Now().Add(lifetime)
+	debugLog("Access token for tenant %s cached until %s", creds.TenantID, c.expires.Format(time.RFC3339))
+	return token, nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Delivery Transports ---
+
+// Envelope is the SMTP envelope of a message being delivered.
+type Envelope struct {
+	From string
+	To   []string // Every envelope recipient, including Bcc
+}
+
+// Attachment is a file attached to an outbound message. Its decoded
+// content is kept in a temporary file for as long as the message is
+// being delivered.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Size        int64
+	path        string
+}
+
+// Open returns the decoded content of the attachment.
+func (a Attachment) Open() (io.ReadCloser, error) {
+	return os.Open(a.path)
+}
+
+// OutboundMessage is a parsed message ready to be handed to a transport.
+type OutboundMessage struct {
+	Subject         string
+	BodyContentType string // "Text" or "HTML"
+	Body            string
+	To              []string
+	Cc              []string
+	Bcc             []string
+	Attachments     []Attachment
+	Header          mail.Header // Top-level header of the original message
+
+	// Recipients, when set, limits delivery of this copy to a subset of the
+	// To, Cc and Bcc lists. To and Cc are still shown where the transport
+	// can show them without delivering; see chunk.go.
+	Recipients []string
+
+	// Delivered are recipients an earlier attempt reached; they are not
+	// sent to again. See chunk.go.
+	Delivered []string
+
+	// Set by rules; see rules.go
+	SetHeaders [][2]string // Headers to add; Graph only accepts X- headers
+	Importance string      // "low", "normal" or "high"; empty leaves it unset
+	Tenant     string      // [Tenant.<name>] to send as, instead of the sender's
+
+	// ReportType makes the message a multipart/report of that type, with
+	// each attachment as a report part; see ndr.go
+	ReportType string
+}
+
+// Transport delivers an outbound message.
+type Transport interface {
+	// Name identifies the transport in logs and delivery results.
+	Name() string
+	// Send delivers msg to allRecipients(msg).
+	Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error)
+}
+
+// DeliveryError is a failed delivery attempt. Temporary errors are caused by
+// the target (throttling, outages, expired credentials) and may succeed
+// elsewhere or later; other errors are caused by the message itself.
+type DeliveryError struct {
+	Err        error
+	StatusCode int // HTTP or SMTP status, if any
+	Temporary  bool
+
+	// Set by sendChunked: the recipients of the copies that failed and of
+	// those that were delivered
+	Failed    []string
+	Delivered []string
+}
+
+func (e *DeliveryError) Error() string { return e.Err.Error() }
+
+func (e *DeliveryError) Unwrap() error { return e.Err }
+
+// temporaryHTTPStatus reports whether an HTTP status points at the target
+// rather than the message. Authentication failures count, because a second
+// app registration may still work.
+func temporaryHTTPStatus(code int) bool {
+	return code == 401 || code == 403 || code == 408 || code == 429 || code >= 500
+}
+
+// isTemporary reports whether err is worth retrying on another target or
+// later. Network errors, a dropped connection and local file errors are;
+// other errors that carry no classification, such as a message that cannot
+// be parsed, would fail the same way again and are not.
+func isTemporary(err error) bool {
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return de.Temporary
+	}
+	var se *smtp.SMTPError
+	if errors.As(err, &se) {
+		return se.Code/100 == 4
+	}
+	var ne net.Error
+	var pe *fs.PathError
+	return errors.As(err, &ne) || errors.As(err, &pe) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// TransportConfig selects and configures a delivery transport.
+type TransportConfig struct {
+	Name      string            // Target name used in logs
+	Type      string            // graph, smtp, file or webhook
+	Graph     *GraphCredentials // nil uses [MicrosoftGraph]
+	SMTPRelay SMTPRelayConfig
+	FileDrop  FileDropConfig
+	Webhook   WebhookConfig
+}
+
+// activeTransport is built from the configuration by loadConfig.
+var activeTransport Transport
+
+func loadTransportConfig(cfg *ini.File) TransportConfig {
+	kind := strings.ToLower(cfg.Section("Delivery").Key("Transport").In("graph", []string{"graph", "smtp", "file", "webhook"}))
+	return TransportConfig{
+		Name:      kind,
+		Type:      kind,
+		SMTPRelay: loadSMTPRelayConfig(cfg.Section("SMTPRelay")),
+		FileDrop:  loadFileDropConfig(cfg.Section("FileDrop")),
+		Webhook:   loadWebhookConfig(cfg.Section("Webhook")),
+	}
+}
+
+// loadTargetConfigs reads the failover targets named in [Delivery] Targets.
+// Each [Target.<name>] section has a Type and the keys of that transport's
+// own section; a graph target with a TenantID uses its own app registration.
+func loadTargetConfigs(cfg *ini.File) []TransportConfig {
+	var targets []TransportConfig
+	for _, name := range cfg.Section("Delivery").Key("Targets").Strings(",") {
+		targets = append(targets, loadTargetConfig(cfg.Section("Target."+name), name))
+	}
+	return targets
+}
+
+func loadTargetConfig(sec *ini.Section, name string) TransportConfig {
+	tc := TransportConfig{
+		Name:      name,
+		Type:      strings.ToLower(sec.Key("Type").MustString("graph")),
+		SMTPRelay: loadSMTPRelayConfig(sec),
+		FileDrop:  loadFileDropConfig(sec),
+		Webhook:   loadWebhookConfig(sec),
+	}
+	if sec.HasKey("TenantID") {
+		tc.Graph = &GraphCredentials{
+			TenantID:     sec.Key("TenantID").String(),
+			ClientID:     sec.Key("ClientID").String(),
+			ClientSecret: sec.Key("ClientSecret").String(),
+			Scope:        sec.Key("Scope").MustString("https://graph.microsoft.com/.default"),
+		}
+	}
+	return tc
+}
+
+// buildDeliveryTransport returns the failover chain when targets are
+// configured and the single [Delivery] transport otherwise.
+func buildDeliveryTransport() (Transport, error) {
+	if len(config.Targets) == 0 {
+		return newTransport(config.Delivery)
+	}
+	failover := &failoverTransport{}
+	for _, tc := range config.Targets {
+		t, err := newTransport(tc)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", tc.Name, err)
+		}
+		failover.targets = append(failover.targets, &deliveryTarget{
+			name:      tc.Name,
+			transport: t,
+			breaker:   &circuitBreaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown},
+		})
+	}
+	return failover, nil
+}
+
+func newTransport(tc TransportConfig) (Transport, error) {
+	switch tc.Type {
+	case "graph":
+		return &graphTransport{creds: tc.Graph}, nil
+	case "smtp":
+		if tc.SMTPRelay.Host == "" {
+			return nil, fmt.Errorf("smtp transport requires SMTPRelay.Host")
+		}
+		return &smtpTransport{cfg: tc.SMTPRelay}, nil
+	case "file":
+		return &fileTransport{cfg: tc.FileDrop}, nil
+	case "webhook":
+		if tc.Webhook.URL == "" {
+			return nil, fmt.Errorf("webhook transport requires Webhook.URL")
+		}
+		return &webhookTransport{cfg: tc.Webhook}, nil
+	}
+	return nil, fmt.Errorf("unknown transport type %q", tc.Type)
+}
+
+// graphTransport sends through the Microsoft Graph sendMail API.
+type graphTransport struct {
+	creds *GraphCredentials // nil uses [MicrosoftGraph]
+}
+
+func (t *graphTransport) Name() string { return "graph" }
+
+func (t *graphTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	creds := config.graphCredentials()
+	switch {
+	case msg.Tenant != "":
+		// Falling back to [MicrosoftGraph] would send from the wrong tenant
+		tenant := tenantByName(msg.Tenant)
+		if tenant == nil {
+			return nil, &DeliveryError{Err: fmt.Errorf("no [Tenant.%s] section to send as", msg.Tenant)}
+		}
+		creds = tenant.Credentials
+	case t.creds != nil:
+		creds = *t.creds
+	case len(config.Tenants) > 0:
+		tenant := tenantForSender(env.From)
+		if tenant == nil {
+			return nil, &DeliveryError{Err: fmt.Errorf("no tenant serves sender %s", env.From)}
+		}
+		debugLog("Sender %s routed to tenant %s", env.From, tenant.Name)
+		creds = tenant.Credentials
+	}
+	// Graph has no envelope: it delivers to every address in the message,
+	// also when sent as MIME. A partial copy can only show the recipients
+	// it is delivered to, or the others would get it once per copy.
+	toList, ccList, bccList := msg.To, msg.Cc, msg.Bcc
+	if msg.Recipients != nil {
+		toList, ccList, bccList = onlyIn(msg.To, msg.Recipients), onlyIn(msg.Cc, msg.Recipients), onlyIn(msg.Bcc, msg.Recipients)
+	}
+	// Graph has no resource for a multipart/report, so reports are sent
+	// as MIME
+	if msg.ReportType != "" {
+		return sendMIME(creds, env, msg)
+	}
+	// Attachments are streamed into the request body by sendMail.
+	graphMessage := buildGraphMessage(msg.Subject, msg.BodyContentType, msg.Body, toList, ccList, bccList, []map[string]interface{}{})
+	message := graphMessage["message"].(map[string]interface{})
+	if msg.Importance != "" {
+		message["importance"] = msg.Importance
+	}
+	var headers []map[string]interface{}
+	for _, h := range msg.SetHeaders {
+		if !strings.HasPrefix(strings.ToLower(h[0]), "x-") {
+			debugLog("Header %s not sent: Graph only accepts X- headers", h[0])
+			continue
+		}
+		headers = append(headers, map[string]interface{}{"name": h[0], "value": h[1]})
+	}
+	if len(headers) > 0 {
+		message["internetMessageHeaders"] = headers
+	}
+	return sendMail(creds, env.From, graphMessage, msg.Attachments)
+}
+
+// graphAttachmentMeta returns the fields of a Graph fileAttachment resource
+// other than its content.
+func graphAttachmentMeta(a Attachment) map[string]interface{} {
+	return map[string]interface{}{
+		"@odata.type": "#microsoft.graph.fileAttachment",
+		"name":        a.Name,
+		"contentType": a.ContentType,
+	}
+}
+
+// renderMessage writes msg to w as an RFC 5322 message for transports that
+// deliver MIME rather than Graph resources, and returns its Message-Id.
+// Bcc is never written.
+func renderMessage(w io.Writer, env *Envelope, msg *OutboundMessage) (string, error) {
+	var h mail.Header
+	h.SetSubject(msg.Subject)
+	h.SetAddressList("From", []*mail.Address{{Address: env.From}})
+	if len(msg.To) > 0 {
+		h.SetAddressList("To", toAddresses(msg.To))
+	}
+	if len(msg.Cc) > 0 {
+		h.SetAddressList("Cc", toAddresses(msg.Cc))
+	}
+	// Keep identifying headers of the original message.
+	for _, key := range []string{"Date", "Message-Id", "Reply-To", "In-Reply-To", "References"} {
+		if v := msg.Header.Get(key); v != "" {
+			h.Set(key, v)
+		}
+	}
+	if msg.Importance != "" {
+		h.Set("Importance", msg.Importance)
+	}
+	for _, hdr := range msg.SetHeaders {
+		h.Set(hdr[0], hdr[1])
+	}
+	if !h.Has("Date") {
+		h.SetDate(time.Now())
+	}
+	if !h.Has("Message-Id") {
+		if err := h.GenerateMessageID(); err != nil {
+			return "", err
+		}
+	}
+	messageID := h.Get("Message-Id")
+	if msg.ReportType != "" {
+		return messageID, writeReport(w, h, msg)
+	}
+
+	mw, err := mail.CreateWriter(w, h)
+	if err != nil {
+		return "", err
+	}
+
+	var th mail.InlineHeader
+	if msg.BodyContentType == "HTML" {
+		th.SetContentType("text/html", map[string]string{"charset": "utf-8"})
+	} else {
+		th.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	}
+	bw, err := mw.CreateSingleInline(th)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(bw, msg.Body); err != nil {
+		return "", err
+	}
+	if err := bw.Close(); err != nil {
+		return "", err
+	}
+
+	for _, a := range msg.Attachments {
+		var ah mail.AttachmentHeader
+		ah.SetContentType(a.ContentType, nil)
+		ah.SetFilename(a.Name)
+		aw, err := mw.CreateAttachment(ah)
+		if err != nil {
+			return "", err
+		}
+		if err := copyAttachment(aw, a); err != nil {
+			return "", err
+		}
+		if err := aw.Close(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+func copyAttachment(w io.Writer, a Attachment) error {
+	r, err := a.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func toAddresses(list []string) []*mail.Address {
+	addrs := make([]*mail.Address, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, &mail.Address{Address: a})
+	}
+	return addrs
+}
+
+// allRecipients returns the recipients msg is delivered to: its Recipients
+// when set, otherwise the To, Cc and Bcc lists.
+func allRecipients(msg *OutboundMessage) []string {
+	if msg.Recipients != nil {
+		return msg.Recipients
+	}
+	var list []string
+	list = append(list, msg.To...)
+	list = append(list, msg.Cc...)
+	list = append(list, msg.Bcc...)
+	return list
+}
+
+// onlyIn returns the addresses of list that are also in subset.
+func onlyIn(list, subset []string) []string {
+	var out []string
+	for _, a := range list {
+		if containsFold(subset, a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// notIn returns the addresses of list that are not in exclude.
+func notIn(list, exclude []string) []string {
+	var out []string
+	for _, a := range list {
+		if !containsFold(exclude, a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
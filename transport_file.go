@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/ini.v1"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileDropConfig configures the file drop transport.
+type FileDropConfig struct {
+	Directory string
+	Format    string // maildir or eml
+}
+
+func loadFileDropConfig(sec *ini.Section) FileDropConfig {
+	return FileDropConfig{
+		Directory: sec.Key("Directory").MustString("maildrop"),
+		Format:    strings.ToLower(sec.Key("Format").In("eml", []string{"eml", "maildir"})),
+	}
+}
+
+// fileTransport writes each message to disk instead of sending it, either as
+// a flat .eml file or into a Maildir (tmp/new/cur).
+type fileTransport struct {
+	cfg FileDropConfig
+}
+
+func (t *fileTransport) Name() string { return "file" }
+
+func (t *fileTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	start := time.Now()
+	id := fmt.Sprintf("%d.%s", start.UnixNano(), uuid.New().String()[:8])
+
+	// Write to a temporary name and rename, so readers never see a partial
+	// message: Maildir's tmp directory, or a .tmp file next to the .eml.
+	var tmp, path string
+	switch t.cfg.Format {
+	case "maildir":
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(t.cfg.Directory, sub), 0700); err != nil {
+				return nil, err
+			}
+		}
+		tmp = filepath.Join(t.cfg.Directory, "tmp", id)
+		path = filepath.Join(t.cfg.Directory, "new", id)
+	default:
+		if err := os.MkdirAll(t.cfg.Directory, 0700); err != nil {
+			return nil, err
+		}
+		path = filepath.Join(t.cfg.Directory, id+".eml")
+		tmp = path + ".tmp"
+	}
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Record the envelope, which a reader of the file could not see otherwise.
+	_, err = fmt.Fprintf(f, "Return-Path: <%s>\r\nX-Envelope-To: %s\r\n", env.From, strings.Join(allRecipients(msg), ", "))
+	if err == nil {
+		_, err = renderMessage(f, env, msg)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, fmt.Errorf("failed to render message: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Message from %s written to %s", env.From, path)
+	return &DeliveryResult{RequestID: id, Attempts: 1, Duration: time.Since(start)}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/ini.v1"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTPRelayConfig configures the SMTP smarthost transport.
+type SMTPRelayConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	TLS      string // starttls, tls or none
+	HeloName string
+}
+
+func loadSMTPRelayConfig(sec *ini.Section) SMTPRelayConfig {
+	return SMTPRelayConfig{
+		Host:     sec.Key("Host").String(),
+		Port:     sec.Key("Port").MustString("587"),
+		Username: sec.Key("Username").String(),
+		Password: sec.Key("Password").String(),
+		TLS:      strings.ToLower(sec.Key("TLS").In("starttls", []string{"starttls", "tls", "none"})),
+		HeloName: sec.Key("HeloName").MustString("localhost"),
+	}
+}
+
+// smtpTransport forwards messages to an SMTP smarthost.
+type smtpTransport struct {
+	cfg SMTPRelayConfig
+}
+
+func (t *smtpTransport) Name() string { return "smtp" }
+
+func (t *smtpTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	start := time.Now()
+
+	// Render to a temporary file first so that a rendering error does not
+	// leave a half-sent message at the smarthost.
+	f, err := createTempFile("render-*.eml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	messageID, err := renderMessage(f, env, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render message: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(t.cfg.Host, t.cfg.Port)
+	tlsConfig := &tls.Config{ServerName: t.cfg.Host}
+
+	var c *smtp.Client
+	switch t.cfg.TLS {
+	case "tls":
+		c, err = smtp.DialTLS(addr, tlsConfig)
+	case "none":
+		c, err = smtp.Dial(addr)
+	default:
+		c, err = smtp.DialStartTLS(addr, tlsConfig)
+	}
+	if err != nil {
+		return nil, &DeliveryError{Err: fmt.Errorf("failed to connect to smarthost %s: %w", addr, err), Temporary: true}
+	}
+	defer c.Close()
+
+	if err := c.Hello(t.cfg.HeloName); err != nil {
+		return nil, err
+	}
+	if t.cfg.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", t.cfg.Username, t.cfg.Password)); err != nil {
+			return nil, &DeliveryError{Err: fmt.Errorf("smarthost authentication failed: %w", err), Temporary: true}
+		}
+	}
+	if err := c.Mail(env.From, nil); err != nil {
+		return nil, err
+	}
+	for _, rcpt := range allRecipients(msg) {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			return nil, fmt.Errorf("smarthost rejected recipient %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := c.Quit(); err != nil {
+		logger.Printf("Smarthost QUIT failed after successful delivery: %v", err)
+	}
+
+	return &DeliveryResult{RequestID: strings.Trim(messageID, "<>"), Attempts: 1, Duration: time.Since(start)}, nil
+}
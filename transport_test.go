@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-smtp"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestIsTemporary(t *testing.T) {
+	_, pathErr := os.Open("/nonexistent/spool/entry")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, dialErr := net.Dial("tcp", l.Addr().String()) // Connection refused
+
+	temporary := []error{
+		&DeliveryError{Err: errors.New("throttled"), Temporary: true},
+		fmt.Errorf("copy 2: %w", &DeliveryError{Err: errors.New("throttled"), Temporary: true}),
+		&smtp.SMTPError{Code: 451, Message: "try later"},
+		dialErr,
+		pathErr,
+		io.ErrUnexpectedEOF,
+		fmt.Errorf("reading reply: %w", io.EOF),
+	}
+	for _, err := range temporary {
+		if !isTemporary(err) {
+			t.Errorf("isTemporary(%v) = false", err)
+		}
+	}
+
+	permanent := []error{
+		&DeliveryError{Err: errors.New("mailbox unavailable")},
+		&smtp.SMTPError{Code: 550, Message: "no such user"},
+		errors.New("invalid email transaction: missing required fields"),
+		fmt.Errorf("failed to parse message: %w", errors.New("malformed MIME header")),
+	}
+	for _, err := range permanent {
+		if isTemporary(err) {
+			t.Errorf("isTemporary(%v) = true", err)
+		}
+	}
+}
+
+func TestSendMailURLEscapesSender(t *testing.T) {
+	// A local part may hold characters that end or redirect the path
+	got := sendMailURL("a/b?c#d@contoso.com")
+	if want := "https://graph.microsoft.com/v1.0/users/a%2Fb%3Fc%23d@contoso.com/sendMail"; got != want {
+		t.Errorf("sendMailURL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/ini.v1"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// WebhookConfig configures the HTTP webhook transport.
+type WebhookConfig struct {
+	URL           string
+	Authorization string // Sent verbatim as the Authorization header, if set
+	Timeout       time.Duration
+}
+
+func loadWebhookConfig(sec *ini.Section) WebhookConfig {
+	return WebhookConfig{
+		URL:           sec.Key("URL").String(),
+		Authorization: sec.Key("Authorization").String(),
+		Timeout:       sec.Key("Timeout").MustDuration(10 * time.Second),
+	}
+}
+
+// webhookPayload is the JSON document posted by the webhook transport.
+type webhookPayload struct {
+	ID       string `json:"id"`
+	Envelope struct {
+		From string   `json:"from"`
+		To   []string `json:"to"`
+	} `json:"envelope"`
+	Subject         string            `json:"subject"`
+	BodyContentType string            `json:"bodyContentType"`
+	Body            string            `json:"body"`
+	To              []string          `json:"to"`
+	Cc              []string          `json:"cc"`
+	Bcc             []string          `json:"bcc"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Importance      string            `json:"importance,omitempty"`
+	Attachments     []struct{}        `json:"attachments"` // Always empty; filled in by writeJSONWithAttachments
+}
+
+// webhookAttachmentMeta returns the fields of an attachment in the payload
+// other than its base64 contentBytes.
+func webhookAttachmentMeta(a Attachment) map[string]interface{} {
+	return map[string]interface{}{"name": a.Name, "contentType": a.ContentType}
+}
+
+// webhookTransport posts each message as JSON to an HTTP endpoint.
+type webhookTransport struct {
+	cfg WebhookConfig
+}
+
+func (t *webhookTransport) Name() string { return "webhook" }
+
+func (t *webhookTransport) Send(env *Envelope, msg *OutboundMessage) (*DeliveryResult, error) {
+	start := time.Now()
+
+	payload := webhookPayload{
+		ID:              uuid.New().String(),
+		Subject:         msg.Subject,
+		BodyContentType: msg.BodyContentType,
+		Body:            msg.Body,
+		To:              append([]string{}, msg.To...),
+		Cc:              append([]string{}, msg.Cc...),
+		Bcc:             append([]string{}, msg.Bcc...),
+		Importance:      msg.Importance,
+		Attachments:     []struct{}{},
+	}
+	for _, h := range msg.SetHeaders {
+		if payload.Headers == nil {
+			payload.Headers = make(map[string]string)
+		}
+		payload.Headers[h[0]] = h[1]
+	}
+	payload.Envelope.From = env.From
+	payload.Envelope.To = allRecipients(msg)
+
+	path, err := writeRequestFile(payload, "attachments", msg.Attachments, webhookAttachmentMeta)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	body, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	req, err := http.NewRequest("POST", t.cfg.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := body.Stat(); err == nil {
+		req.ContentLength = info.Size()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.cfg.Authorization != "" {
+		req.Header.Set("Authorization", t.cfg.Authorization)
+	}
+
+	client := &http.Client{Timeout: t.cfg.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := resp.Body.Close(); cerr != nil {
+			logger.Printf("Error closing response body: %v", cerr)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &DeliveryError{
+			Err:        fmt.Errorf("webhook error (%s): %s", resp.Status, string(responseBody)),
+			StatusCode: resp.StatusCode,
+			Temporary:  temporaryHTTPStatus(resp.StatusCode),
+		}
+	}
+
+	requestID := resp.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = payload.ID
+	}
+	return &DeliveryResult{RequestID: requestID, Attempts: 1, Duration: time.Since(start)}, nil
+}